@@ -0,0 +1,181 @@
+package hkp
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// ErrUnauthorized indicates that a request lacks valid credentials. Handler
+// replies with 401 Unauthorized.
+var ErrUnauthorized = errors.New("hkp: unauthorized")
+
+// Principal is an authenticated user.
+type Principal struct {
+	// Name identifies the principal, e.g. a user name or a certificate
+	// subject.
+	Name string
+	// Certificate is the TLS client certificate used to authenticate, if
+	// any.
+	Certificate *x509.Certificate
+}
+
+// Authenticator checks the credentials of an HTTP request.
+//
+// If the request doesn't contain valid credentials, ErrUnauthorized should
+// be returned.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthenticatedAdder is an Adder which needs to know the principal who
+// uploaded keys, e.g. to only allow publishing keys with identities in the
+// principal's domain.
+//
+// When Handler has an Authenticator and its Adder implements
+// AuthenticatedAdder, AddAuthenticated is called instead of Add.
+type AuthenticatedAdder interface {
+	Adder
+	AddAuthenticated(p *Principal, el openpgp.EntityList) error
+}
+
+// challenger is implemented by Authenticators which know which
+// authentication scheme the client should use.
+type challenger interface {
+	challenge() string
+}
+
+// AuthenticatorFunc is an adapter to allow the use of an ordinary function
+// as an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+// Authenticate implements Authenticator.
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return f(r)
+}
+
+// TokenAuthenticator authenticates requests with bearer tokens. It maps
+// tokens to principal names.
+type TokenAuthenticator map[string]string
+
+// Authenticate implements Authenticator.
+func (tokens TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, ErrUnauthorized
+	}
+
+	// Compare all tokens to avoid leaking timing information
+	var principal *Principal
+	for t, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			principal = &Principal{Name: name}
+		}
+	}
+	if principal == nil {
+		return nil, ErrUnauthorized
+	}
+	return principal, nil
+}
+
+func (tokens TokenAuthenticator) challenge() string {
+	return `Bearer realm="hkp"`
+}
+
+// BasicAuthenticator authenticates requests with HTTP basic authentication.
+// It returns true if the credentials are valid.
+type BasicAuthenticator func(username, password string) bool
+
+// Authenticate implements Authenticator.
+func (f BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || !f(username, password) {
+		return nil, ErrUnauthorized
+	}
+	return &Principal{Name: username}, nil
+}
+
+func (f BasicAuthenticator) challenge() string {
+	return `Basic realm="hkp"`
+}
+
+// CertificateAuthenticator authenticates requests with TLS client
+// certificates. The http.Server's TLS configuration must verify client
+// certificates, e.g. by setting ClientAuth to tls.VerifyClientCertIfGiven.
+//
+// The principal name is the first email address of the certificate, or its
+// subject common name if it has none.
+type CertificateAuthenticator struct{}
+
+// Authenticate implements Authenticator.
+func (CertificateAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrUnauthorized
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	name := cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		name = cert.EmailAddresses[0]
+	}
+	return &Principal{Name: name, Certificate: cert}, nil
+}
+
+// MultiAuthenticator tries multiple Authenticators in order, and returns the
+// first principal successfully authenticated.
+type MultiAuthenticator []Authenticator
+
+// Authenticate implements Authenticator.
+func (auths MultiAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	for _, auth := range auths {
+		p, err := auth.Authenticate(r)
+		if err != ErrUnauthorized {
+			return p, err
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+func (auths MultiAuthenticator) challenge() string {
+	var l []string
+	for _, auth := range auths {
+		if c, ok := auth.(challenger); ok {
+			l = append(l, c.challenge())
+		}
+	}
+	return strings.Join(l, ", ")
+}
+
+// authenticate checks the credentials of a request. If authentication fails,
+// an error response is written and false is returned.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	if h.Authenticator == nil {
+		return nil, true
+	}
+
+	p, err := h.Authenticator.Authenticate(r)
+	if err == ErrUnauthorized {
+		if c, ok := h.Authenticator.(challenger); ok && c.challenge() != "" {
+			w.Header().Set("WWW-Authenticate", c.challenge())
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	} else if err != nil {
+		httpError(w, err)
+		return nil, false
+	}
+	return p, true
+}
+
+// setCredentials adds the client's credentials, if any, to a request.
+func (c *Client) setCredentials(req *http.Request) {
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
@@ -0,0 +1,187 @@
+package hkp
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// batchHeader is the HTTP header field set by Handler on lookup responses to
+// advertise support for batch requests. This is an extension to HKP.
+//
+// A batch get request is a regular get request with multiple search
+// parameters, each containing a full fingerprint. Since batches don't
+// necessarily fit in a URL, the parameters can be sent in a POST request
+// body.
+const batchHeader = "Hkp-Batch"
+
+const (
+	// maxBatchSize is the maximum number of searches accepted by Handler in
+	// a batch request.
+	maxBatchSize = 1000
+	// clientBatchSize is the number of fingerprints sent by Client in a
+	// single batch request.
+	clientBatchSize = 100
+	// clientMaxConcurrency is the maximum number of concurrent requests sent
+	// by Client when a server doesn't support batch requests.
+	clientMaxConcurrency = 8
+)
+
+var errBatchUnsupported = errors.New("hkp: server doesn't support batch requests")
+
+func (h *Handler) serveBatchGet(w http.ResponseWriter, r *http.Request, req *LookupRequest, searches []string) {
+	if len(searches) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Too many searches (maximum is %v)", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var (
+		el   openpgp.EntityList
+		seen = make(map[string]bool)
+	)
+	for _, search := range searches {
+		if ParseKeyIDSearch(search).Fingerprint() == nil {
+			http.Error(w, "Batch requests must search for fingerprints", http.StatusBadRequest)
+			return
+		}
+
+		req := *req
+		req.Search = search
+		req.Exact = true
+		res, err := h.Lookuper.Get(&req)
+		if err == nil {
+			res, err = h.filterEntities(&req, res)
+		}
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		for _, e := range res {
+			k := string(e.PrimaryKey.Fingerprint)
+			if !seen[k] {
+				seen[k] = true
+				el = append(el, e)
+			}
+		}
+	}
+
+	if len(el) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	h.writeKeys(w, r, el, &req.Options, time.Time{})
+}
+
+func fingerprintSearch(fingerprint []byte) string {
+	return "0x" + strings.ToUpper(hex.EncodeToString(fingerprint))
+}
+
+func (c *Client) getBatch(fingerprints [][]byte) (openpgp.EntityList, error) {
+	u, err := c.url(lookupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	v := url.Values{}
+	v.Set("op", "get")
+	v.Set("options", (&LookupOptions{}).format())
+	v.Set("exact", "on")
+	v.Set("fingerprint", "on")
+	for _, fingerprint := range fingerprints {
+		v.Add("search", fingerprintSearch(fingerprint))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Batch lookups are idempotent, even if sent with POST
+	resp, err := c.doRetry(req, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(batchHeader) == "" {
+		return nil, errBatchUnsupported
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, "get keys")
+	}
+
+	return readKeyRing(resp.Body)
+}
+
+func (c *Client) getEach(fingerprints [][]byte) (openpgp.EntityList, error) {
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		el       openpgp.EntityList
+		firstErr error
+	)
+	sem := make(chan struct{}, clientMaxConcurrency)
+	for _, fingerprint := range fingerprints {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(fingerprint []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			req := LookupRequest{Search: fingerprintSearch(fingerprint), Exact: true}
+			res, err := c.Get(&req)
+			if errors.Is(err, ErrNotFound) {
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			el = append(el, res...)
+		}(fingerprint)
+	}
+	wg.Wait()
+
+	return el, firstErr
+}
+
+// GetMany retrieves keys by full fingerprint. Keys which can't be found are
+// omitted from the result.
+//
+// If the server supports batch requests, keys are fetched with few requests.
+// Otherwise, a separate request is sent for each key.
+func (c *Client) GetMany(fingerprints [][]byte) (openpgp.EntityList, error) {
+	var el openpgp.EntityList
+	for i := 0; i < len(fingerprints); i += clientBatchSize {
+		end := i + clientBatchSize
+		if end > len(fingerprints) {
+			end = len(fingerprints)
+		}
+
+		res, err := c.getBatch(fingerprints[i:end])
+		if err == errBatchUnsupported {
+			res, err := c.getEach(fingerprints[i:])
+			return append(el, res...), err
+		} else if err != nil {
+			return el, err
+		}
+		el = append(el, res...)
+	}
+	return el, nil
+}
@@ -0,0 +1,259 @@
+package hkp
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModTimeLookuper is an optional interface implemented by Lookupers able to
+// tell when the keys matching a request were last modified. Handler uses it
+// to populate the Last-Modified header field.
+type ModTimeLookuper interface {
+	ModTime(req *LookupRequest) (time.Time, error)
+}
+
+func (h *Handler) modTime(req *LookupRequest) (time.Time, error) {
+	if mtl, ok := h.Lookuper.(ModTimeLookuper); ok {
+		return mtl.ModTime(req)
+	}
+	return time.Time{}, nil
+}
+
+// serveLookupResult writes a lookup response body, along with caching header
+// fields. Conditional requests are handled.
+func (h *Handler) serveLookupResult(w http.ResponseWriter, r *http.Request, body []byte, modTime time.Time) {
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Vary", "Accept")
+	if h.CacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(h.CacheMaxAge/time.Second)))
+	}
+
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
+
+// CachedResponse is an HTTP response stored in a Cache.
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Expires is the time after which the response needs to be revalidated
+	// with the server.
+	Expires time.Time
+}
+
+// Cache stores keyserver responses for Client. It must be safe to use from
+// multiple goroutines.
+type Cache interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+}
+
+type lruEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// LRUCache is an in-memory Cache. When full, the least recently used
+// responses are evicted.
+type LRUCache struct {
+	size int
+
+	mutex   sync.Mutex
+	list    *list.List
+	entries map[string]*list.Element
+}
+
+var _ Cache = (*LRUCache)(nil)
+
+// NewLRUCache creates a new in-memory cache holding at most size responses.
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		list:    list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get implements Cache.
+func (c *LRUCache) Get(key string) (*CachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.list.MoveToFront(elem)
+	return elem.Value.(*lruEntry).resp, true
+}
+
+// Set implements Cache.
+func (c *LRUCache) Set(key string, resp *CachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruEntry).resp = resp
+		c.list.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.list.PushFront(&lruEntry{key, resp})
+	for c.list.Len() > c.size {
+		elem := c.list.Back()
+		c.list.Remove(elem)
+		delete(c.entries, elem.Value.(*lruEntry).key)
+	}
+}
+
+// cacheKey returns a normalized key for a lookup request.
+func cacheKey(req *http.Request) string {
+	q := req.URL.Query()
+	if search := ParseKeyIDSearch(q.Get("search")); search != nil {
+		q.Set("search", "0x"+strings.ToUpper(hex.EncodeToString(search)))
+	}
+
+	u := *req.URL
+	u.RawQuery = q.Encode()
+	return req.Method + " " + u.String() + " " + req.Header.Get("Accept")
+}
+
+// cacheExpiration returns the time after which a response becomes stale. It
+// returns false if the response must not be stored.
+func cacheExpiration(header http.Header, now time.Time) (time.Time, bool) {
+	var (
+		noCache bool
+		maxAge  = int64(-1)
+	)
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			return time.Time{}, false
+		case "no-cache":
+			noCache = true
+		case "max-age":
+			if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+				maxAge = sec
+			}
+		}
+	}
+
+	if noCache {
+		return now, true
+	} else if maxAge >= 0 {
+		age, _ := strconv.ParseInt(header.Get("Age"), 10, 64)
+		return now.Add(time.Duration(maxAge-age) * time.Second), true
+	} else if s := header.Get("Expires"); s != "" {
+		// Invalid dates mean that the response has already expired
+		t, _ := http.ParseTime(s)
+		return t, true
+	}
+
+	return now, true
+}
+
+func (resp *CachedResponse) httpResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode)),
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        resp.Header,
+		Body:          io.NopCloser(bytes.NewReader(resp.Body)),
+		ContentLength: int64(len(resp.Body)),
+		Request:       req,
+	}
+}
+
+// doCached sends an HTTP request, using the client's cache if any.
+func (c *Client) doCached(req *http.Request) (*http.Response, error) {
+	if c.Cache == nil || req.Method != http.MethodGet {
+		return c.do(req)
+	}
+
+	key := cacheKey(req)
+	cached, ok := c.Cache.Get(key)
+	if ok && time.Now().Before(cached.Expires) {
+		return cached.httpResponse(req), nil
+	}
+
+	if ok {
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if ok && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
+		// Only a subset of header fields is updated by a 304 response
+		updated := *cached
+		updated.Header = cached.Header.Clone()
+		for _, k := range []string{"Cache-Control", "Expires", "Date", "ETag", "Age"} {
+			if v := resp.Header.Values(k); len(v) > 0 {
+				updated.Header[k] = v
+			}
+		}
+		updated.Expires, _ = cacheExpiration(updated.Header, now)
+		c.Cache.Set(key, &updated)
+		return updated.httpResponse(req), nil
+	}
+
+	expires, store := cacheExpiration(resp.Header, now)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Cacheable
+	case http.StatusNotFound:
+		if c.NegativeCacheTTL <= 0 {
+			return resp, nil
+		}
+		if resp.Header.Get("Cache-Control") == "" && resp.Header.Get("Expires") == "" {
+			expires = now.Add(c.NegativeCacheTTL)
+		}
+	default:
+		return resp, nil
+	}
+	if !store {
+		return resp, nil
+	}
+	if !expires.After(now) && resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" {
+		// The response can't be reused nor revalidated
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	cached = &CachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Expires:    expires,
+	}
+	c.Cache.Set(key, cached)
+	return cached.httpResponse(req), nil
+}
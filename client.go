@@ -2,48 +2,194 @@ package hkp
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
 type Client struct {
-	Host     string
+	// Host is the address of the keyserver. It can be a URI with the hkp,
+	// hkps, http or https scheme, e.g. "hkps://keys.openpgp.org", or a host
+	// name. For hkp and hkps URIs without a port, the keyserver is
+	// discovered with DNS SRV records, like GnuPG does.
+	Host string
+	// Insecure allows connecting to keyservers over plain HTTP.
 	Insecure bool
+	// BinaryUpload makes Add upload keys in binary form in a multipart form,
+	// instead of ASCII-armored in a URL-encoded form.
+	BinaryUpload bool
+	// Cache, if non-nil, is used to store lookup responses.
+	Cache Cache
+	// NegativeCacheTTL is the duration during which "not found" responses
+	// are cached when the server doesn't specify it. If zero, these
+	// responses aren't cached.
+	NegativeCacheTTL time.Duration
+	// Retry, if non-nil, is the policy used to retry failed requests.
+	Retry *RetryPolicy
+
+	// BearerToken, if set, is sent along with uploads.
+	BearerToken string
+	// Username and Password, if set, are sent along with uploads using HTTP
+	// basic authentication.
+	Username, Password string
+
+	// HTTPClient is the HTTP client used to send requests. If nil,
+	// http.DefaultClient is used. TLS client certificates can be configured
+	// in its transport.
+	HTTPClient *http.Client
+
+	// TLSConfig, if non-nil, is the TLS configuration used to connect to
+	// the keyserver. It overrides the one of HTTPClient's transport.
+	// Otherwise, CAFile and PinnedSPKI are applied on top of the
+	// transport's configuration.
+	TLSConfig *tls.Config
+	// CAFile is the path to a PEM file containing the root certificates
+	// used to verify the keyserver's certificate, instead of the system
+	// roots.
+	CAFile string
+	// PinnedSPKI is a list of base64-encoded SHA-256 digests of
+	// SubjectPublicKeyInfo, as used by HPKP and curl's --pinnedpubkey. If
+	// non-empty, the certificate chain of the keyserver must contain one of
+	// these public keys, otherwise requests fail with a *PinError. Pins are
+	// checked in addition to the usual certificate verification, against
+	// the verified chains only. If InsecureSkipVerify is set, only the
+	// leaf certificate is checked.
+	PinnedSPKI []string
+
+	// SOCKSProxy, if non-empty, is the address of a SOCKS5 proxy used to
+	// connect to the keyserver, e.g. DefaultTorProxy. Host names are
+	// resolved by the proxy and SRV lookups are skipped, so that the local
+	// resolver doesn't see which keyserver is contacted.
+	SOCKSProxy string
+	// IsolateStreams makes each request use a new connection with unique
+	// SOCKS credentials, so that Tor routes it over a separate circuit and
+	// lookups can't be linked together.
+	IsolateStreams bool
+
+	// TLS and SOCKS options must not be modified after the first request.
+	transportMutex  sync.Mutex
+	transportClient *http.Client
 }
 
-func (c *Client) hostURL() (*url.URL, error) {
-	if u, err := url.Parse(c.Host); err == nil {
-		if !c.Insecure && u.Scheme != "https" {
-			return nil, fmt.Errorf("hkp: refusing to connect to non-HTTPS keyserver")
-		}
-		return u, nil
+// ParseKeyserverURI creates a client from a keyserver URI, as used in GnuPG
+// configuration files, e.g. "hkps://keys.openpgp.org" or
+// "hkp://pgp.mit.edu:11371". The http and https schemes are also accepted.
+//
+// Since hkp and http URIs explicitly request plain HTTP, the returned client
+// has Insecure set for these. A bare host name is interpreted as an hkps URI.
+func ParseKeyserverURI(s string) (*Client, error) {
+	if !strings.Contains(s, "://") {
+		s = "hkps://" + s
 	}
 
-	host := c.Host
-	_, addrs, err := net.LookupSRV("hkp", "tcp", host)
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("hkp: invalid keyserver URI: %v", err)
+	}
+
+	var c Client
+	switch u.Scheme {
+	case "hkp", "http":
+		c.Insecure = true
+	case "hkps", "https":
+		// No-op
+	default:
+		return nil, fmt.Errorf("hkp: unsupported keyserver URI scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("hkp: missing host in keyserver URI %q", s)
+	}
+
+	c.Host = s
+	return &c, nil
+}
+
+// lookupSRV resolves the host and port of a keyserver with a DNS SRV
+// record. If there is no such record, the host is returned unchanged. SRV
+// lookups are skipped for onion services and when a SOCKS proxy is used.
+func (c *Client) lookupSRV(service, host string) (string, error) {
+	if c.SOCKSProxy != "" || isOnion(host) {
+		return host, nil
+	}
+
+	_, addrs, err := net.LookupSRV(service, "tcp", host)
 	if dnsErr, ok := err.(*net.DNSError); ok {
 		if dnsErr.IsTemporary {
-			return nil, err
+			return "", err
 		}
 	} else if err != nil {
-		return nil, err
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return host, nil
+	}
+	addr := addrs[0]
+	return net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port))), nil
+}
+
+func (c *Client) hostURL() (*url.URL, error) {
+	if !strings.Contains(c.Host, "://") {
+		host, err := c.lookupSRV("hkp", c.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		scheme := "https"
+		if c.Insecure {
+			scheme = "http"
+		}
+		return &url.URL{Scheme: scheme, Host: host}, nil
 	}
-	if len(addrs) > 0 {
-		addr := addrs[0]
-		host = fmt.Sprintf("%v:%v", addr.Target, addr.Port)
+
+	u, err := url.Parse(c.Host)
+	if err != nil {
+		return nil, fmt.Errorf("hkp: invalid keyserver URI: %v", err)
 	}
 
-	scheme := "https"
-	if c.Insecure {
-		scheme = "http"
+	switch u.Scheme {
+	case "hkp", "hkps":
+		service, scheme, port := "pgpkey-https", "https", ""
+		if u.Scheme == "hkp" {
+			service, scheme, port = "pgpkey-http", "http", hkpPort
+		}
+
+		// An explicit port disables SRV lookups, like in GnuPG
+		host := u.Host
+		if u.Port() == "" {
+			host, err = c.lookupSRV(service, u.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			if host == u.Hostname() && port != "" {
+				host = net.JoinHostPort(host, port)
+			}
+		}
+
+		u = &url.URL{Scheme: scheme, Host: host, Path: u.Path}
+	case "http", "https":
+		// No-op
+	default:
+		return nil, fmt.Errorf("hkp: unsupported keyserver URI scheme %q", u.Scheme)
 	}
 
-	return &url.URL{Scheme: scheme, Host: host}, nil
+	if !c.Insecure && u.Scheme != "https" {
+		return nil, fmt.Errorf("hkp: refusing to connect to non-HTTPS keyserver")
+	}
+	return u, nil
 }
 
 func (c *Client) url(p string) (*url.URL, error) {
@@ -56,7 +202,7 @@ func (c *Client) url(p string) (*url.URL, error) {
 	return u, nil
 }
 
-func (c *Client) lookup(op string, req *LookupRequest) (*http.Response, error) {
+func (c *Client) lookup(ctx context.Context, op string, req *LookupRequest) (*http.Response, error) {
 	u, err := c.url(lookupPath)
 	if err != nil {
 		return nil, err
@@ -72,25 +218,125 @@ func (c *Client) lookup(op string, req *LookupRequest) (*http.Response, error) {
 	q.Set("fingerprint", "on") // implicit
 	u.RawQuery = q.Encode()
 
-	return http.Get(u.String())
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.Options.JSON {
+		httpReq.Header.Set("Accept", jsonMediaType)
+	}
+	if req.Options.Binary {
+		httpReq.Header.Add("Accept", binaryMediaType)
+	}
+
+	return c.doCached(httpReq)
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	return c.doRetry(req, idempotent)
+}
+
+func (c *Client) hasTransportOptions() bool {
+	return c.TLSConfig != nil || c.CAFile != "" || len(c.PinnedSPKI) > 0 || c.SOCKSProxy != ""
+}
+
+// httpClient returns the HTTP client used to send requests. If TLS or SOCKS
+// options are set, an HTTP client with a custom transport is created on
+// first use.
+func (c *Client) httpClient() (*http.Client, error) {
+	if !c.hasTransportOptions() {
+		if c.HTTPClient != nil {
+			return c.HTTPClient, nil
+		}
+		return http.DefaultClient, nil
+	}
+
+	c.transportMutex.Lock()
+	defer c.transportMutex.Unlock()
+
+	if c.transportClient != nil {
+		return c.transportClient, nil
+	}
+
+	var httpClient http.Client
+	if c.HTTPClient != nil {
+		httpClient = *c.HTTPClient
+	}
+
+	var transport *http.Transport
+	switch rt := httpClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = rt.Clone()
+	default:
+		return nil, errors.New("hkp: TLS and SOCKS options require the HTTP client to use an *http.Transport")
+	}
+
+	if c.TLSConfig != nil || c.CAFile != "" || len(c.PinnedSPKI) > 0 {
+		config, err := c.tlsConfig(transport.TLSClientConfig)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+
+	if c.SOCKSProxy != "" {
+		dialer := socksDialer{proxyAddr: c.SOCKSProxy, isolate: c.IsolateStreams}
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		// Connections can't be shared between isolated requests
+		transport.DisableKeepAlives = c.IsolateStreams
+	}
+
+	httpClient.Transport = transport
+	c.transportClient = &httpClient
+	return c.transportClient, nil
 }
 
+// send sends a single HTTP request.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	httpClient, err := c.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+// Index searches for keys. If the server reports that no key matches the
+// search, ErrNotFound is returned, like Get.
 func (c *Client) Index(req *LookupRequest) ([]IndexKey, error) {
-	resp, err := c.lookup("index", req)
+	return c.IndexContext(context.Background(), req)
+}
+
+// IndexContext is like Index, but with a context.
+func (c *Client) IndexContext(ctx context.Context, req *LookupRequest) ([]IndexKey, error) {
+	resp, err := c.lookup(ctx, "index", req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("hkp: failed to get index: %v %v", resp.StatusCode, resp.Status)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, "get index")
 	}
 
+	if hasMediaType(resp, jsonMediaType) {
+		return readIndexJSON(resp.Body)
+	}
 	return readIndex(resp.Body)
 }
 
 func (c *Client) Get(req *LookupRequest) (openpgp.EntityList, error) {
-	resp, err := c.lookup("get", req)
+	return c.GetContext(context.Background(), req)
+}
+
+// GetContext is like Get, but with a context.
+func (c *Client) GetContext(ctx context.Context, req *LookupRequest) (openpgp.EntityList, error) {
+	resp, err := c.lookup(ctx, "get", req)
 	if err != nil {
 		return nil, err
 	}
@@ -99,33 +345,102 @@ func (c *Client) Get(req *LookupRequest) (openpgp.EntityList, error) {
 	if resp.StatusCode == http.StatusNotFound {
 		return nil, ErrNotFound
 	} else if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("hkp: failed to get key: %v %v", resp.StatusCode, resp.Status)
+		return nil, statusError(resp, "get key")
+	}
+
+	return readKeyRing(resp.Body)
+}
+
+// Stats contains the statistics page of a keyserver. Its format isn't
+// standardized: most keyservers return an HTML page, some return JSON.
+type Stats struct {
+	ContentType string
+	Body        []byte
+}
+
+// Stats fetches the statistics page of the keyserver.
+func (c *Client) Stats() (*Stats, error) {
+	return c.StatsContext(context.Background())
+}
+
+// StatsContext is like Stats, but with a context.
+func (c *Client) StatsContext(ctx context.Context) (*Stats, error) {
+	resp, err := c.lookup(ctx, "stats", &LookupRequest{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, "get stats")
 	}
 
-	return openpgp.ReadArmoredKeyRing(resp.Body)
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Stats{ContentType: resp.Header.Get("Content-Type"), Body: b}, nil
 }
 
 func (c *Client) Add(el openpgp.EntityList) error {
+	return c.AddContext(context.Background(), el)
+}
+
+// AddContext is like Add, but with a context.
+func (c *Client) AddContext(ctx context.Context, el openpgp.EntityList) error {
 	u, err := c.url(addPath)
 	if err != nil {
 		return err
 	}
 
-	var b bytes.Buffer
-	if err := serializeArmoredKeyRing(&b, el); err != nil {
-		return err
+	var (
+		body        bytes.Buffer
+		contentType string
+	)
+	if c.BinaryUpload {
+		mw := multipart.NewWriter(&body)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="keytext"; filename="keys.pgp"`)
+		h.Set("Content-Type", binaryMediaType)
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if err := serializeKeyRing(pw, el); err != nil {
+			return err
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+		contentType = mw.FormDataContentType()
+	} else {
+		var b bytes.Buffer
+		if err := serializeArmoredKeyRing(&b, el); err != nil {
+			return err
+		}
+
+		v := url.Values{}
+		v.Set("keytext", b.String())
+		body.WriteString(v.Encode())
+		contentType = "application/x-www-form-urlencoded"
 	}
 
-	v := url.Values{}
-	v.Set("keytext", b.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	c.setCredentials(req)
 
-	resp, err := http.PostForm(u.String(), v)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
-	} else if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("hkp: failed to add key: %v %v", resp.StatusCode, resp.Status)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode/100 != 2 {
+		return statusError(resp, "add key")
+	}
+
 	return nil
 }
@@ -0,0 +1,433 @@
+// Command hkp is a client for OpenPGP HTTP Keyserver Protocol (HKP)
+// keyservers.
+//
+// Usage:
+//
+//	hkp [-keyserver uri] [-insecure] <command> [options] [arguments]
+//
+// Commands:
+//
+//	search  search for keys
+//	get     fetch keys
+//	send    upload keys read from files or stdin
+//	refresh update keys read from files or stdin
+//	stats   print keyserver statistics
+//
+// The exit code is 0 on success, 1 on error, 2 on usage error and 3 if no
+// key has been found.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+const (
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+var errUsage = errors.New("usage error")
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, c *hkp.Client, args []string) error
+}
+
+var commands = []command{
+	{"search", "search [-exact] [-o text|json] <query>", runSearch},
+	{"get", "get [-exact] [-o armor|binary] <query>...", runGet},
+	{"send", "send [file]...", runSend},
+	{"refresh", "refresh [-max-delay duration] [-o armor|binary] [file]...", runRefresh},
+	{"stats", "stats", runStats},
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: hkp [options] <command> [arguments]\n\nOptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %v\n", cmd.usage)
+	}
+}
+
+func main() {
+	keyserver := flag.String("keyserver", "", "keyserver URI (hkp://, hkps://, http:// or https://), defaults to the GnuPG configuration")
+	insecure := flag.Bool("insecure", false, "allow connecting to keyservers over plain HTTP")
+	timeout := flag.Duration("timeout", time.Minute, "timeout for the whole operation")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == flag.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "hkp: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	c, err := newClient(*keyserver)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	if *insecure {
+		c.Insecure = true
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	err = cmd.run(ctx, c, flag.Args()[1:])
+	switch {
+	case err == nil:
+		return
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "usage: hkp %v\n", cmd.usage)
+		os.Exit(exitUsage)
+	case errors.Is(err, hkp.ErrNotFound):
+		fmt.Fprintf(os.Stderr, "hkp: no key found\n")
+		os.Exit(exitNotFound)
+	default:
+		msg := err.Error()
+		if !strings.HasPrefix(msg, "hkp: ") {
+			msg = "hkp: " + msg
+		}
+		fmt.Fprintln(os.Stderr, msg)
+		os.Exit(exitError)
+	}
+}
+
+// newClient creates a client for a keyserver URI. If the URI is empty, the
+// first keyserver of the GnuPG configuration is used.
+func newClient(keyserver string) (*hkp.Client, error) {
+	if keyserver != "" {
+		return hkp.ParseKeyserverURI(keyserver)
+	}
+
+	cfg, err := hkp.LoadGnuPGConfig()
+	if err != nil {
+		return nil, err
+	}
+	clients, err := cfg.Clients()
+	if err != nil {
+		return nil, err
+	}
+	return clients[0], nil
+}
+
+// newFlagSet creates a flag set for a command. Errors are reported with
+// errUsage.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	return nil
+}
+
+func runSearch(ctx context.Context, c *hkp.Client, args []string) error {
+	fs := newFlagSet("search")
+	exact := fs.Bool("exact", false, "")
+	format := fs.String("o", "text", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (*format != "text" && *format != "json") {
+		return errUsage
+	}
+
+	req := hkp.LookupRequest{
+		Search: fs.Arg(0),
+		Exact:  *exact,
+		// The JSON index contains more information, e.g. elliptic curves
+		Options: hkp.LookupOptions{JSON: true},
+	}
+	keys, err := c.IndexContext(ctx, &req)
+	if err != nil {
+		return err
+	} else if len(keys) == 0 {
+		return hkp.ErrNotFound
+	}
+
+	if *format == "json" {
+		return hkp.WriteIndexJSON(os.Stdout, keys)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	for _, key := range keys {
+		writeIndexKey(w, &key)
+	}
+	return w.Flush()
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func formatFlags(flags hkp.IndexFlags, expires time.Time) string {
+	var l []string
+	if flags&hkp.IndexKeyRevoked != 0 {
+		l = append(l, "[revoked]")
+	}
+	if flags&hkp.IndexKeyDisabled != 0 {
+		l = append(l, "[disabled]")
+	}
+	if flags&hkp.IndexKeyExpired != 0 {
+		l = append(l, "[expired: "+formatDate(expires)+"]")
+	} else if !expires.IsZero() {
+		l = append(l, "[expires: "+formatDate(expires)+"]")
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	return " " + strings.Join(l, " ")
+}
+
+// writeIndexKey writes a human-readable description of a key, similar to
+// gpg's output.
+func writeIndexKey(w io.Writer, key *hkp.IndexKey) {
+	fmt.Fprintf(w, "pub   %v %v%v\n", key.AlgoString(), formatDate(key.CreationTime), formatFlags(key.Flags, key.ExpirationTime))
+	fmt.Fprintf(w, "      %X\n", key.Fingerprint)
+	for _, ident := range key.Identities {
+		fmt.Fprintf(w, "uid   %v%v\n", ident.Name, formatFlags(ident.Flags, ident.ExpirationTime))
+	}
+	for _, sk := range key.Subkeys {
+		fmt.Fprintf(w, "sub   %v %v%v\n", sk.AlgoString(), formatDate(sk.CreationTime), formatFlags(sk.Flags, sk.ExpirationTime))
+	}
+	fmt.Fprintln(w)
+}
+
+// writeKeys writes keys to stdout, either ASCII-armored or in binary form.
+func writeKeys(el openpgp.EntityList, format string) error {
+	w := bufio.NewWriter(os.Stdout)
+
+	var out io.WriteCloser = nopCloser{w}
+	if format == "armor" {
+		aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+		if err != nil {
+			return err
+		}
+		out = aw
+	}
+
+	for _, e := range el {
+		if err := e.Serialize(out); err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if format == "armor" {
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func isKeyFormat(format string) bool {
+	return format == "armor" || format == "binary"
+}
+
+func runGet(ctx context.Context, c *hkp.Client, args []string) error {
+	fs := newFlagSet("get")
+	exact := fs.Bool("exact", false, "")
+	format := fs.String("o", "armor", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || !isKeyFormat(*format) {
+		return errUsage
+	}
+
+	var el openpgp.EntityList
+	for _, search := range fs.Args() {
+		req := hkp.LookupRequest{Search: search, Exact: *exact}
+		res, err := c.GetContext(ctx, &req)
+		if err == hkp.ErrNotFound {
+			fmt.Fprintf(os.Stderr, "hkp: no key found for %q\n", search)
+			continue
+		} else if err != nil {
+			return err
+		}
+		el = append(el, res...)
+	}
+	if len(el) == 0 {
+		return hkp.ErrNotFound
+	}
+
+	return writeKeys(el, *format)
+}
+
+// readKeys reads keys from files, or from stdin if no file is specified.
+// Keys can be ASCII-armored or in binary form.
+func readKeys(filenames []string) (openpgp.EntityList, error) {
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
+
+	var el openpgp.EntityList
+	for _, filename := range filenames {
+		var (
+			b   []byte
+			err error
+		)
+		if filename == "-" {
+			b, err = io.ReadAll(os.Stdin)
+		} else {
+			b, err = os.ReadFile(filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var res openpgp.EntityList
+		if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+			res, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		} else {
+			res, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys from %q: %v", filename, err)
+		}
+		el = append(el, res...)
+	}
+	return el, nil
+}
+
+func runSend(ctx context.Context, c *hkp.Client, args []string) error {
+	fs := newFlagSet("send")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	el, err := readKeys(fs.Args())
+	if err != nil {
+		return err
+	}
+	if err := c.AddContext(ctx, el); err != nil {
+		return err
+	}
+
+	for _, e := range el {
+		fmt.Fprintf(os.Stderr, "hkp: sent key %X\n", e.PrimaryKey.Fingerprint)
+	}
+	return nil
+}
+
+func formatChanges(changes hkp.RefreshChanges) string {
+	var l []string
+	if changes&hkp.RefreshNewRevocation != 0 {
+		l = append(l, "new revocation")
+	}
+	if changes&hkp.RefreshNewSubkey != 0 {
+		l = append(l, "new subkey")
+	}
+	if changes&hkp.RefreshNewIdentity != 0 {
+		l = append(l, "new identity")
+	}
+	if changes&hkp.RefreshExpirationChanged != 0 {
+		l = append(l, "expiration changed")
+	}
+	if len(l) == 0 {
+		return "unchanged"
+	}
+	return strings.Join(l, ", ")
+}
+
+func runRefresh(ctx context.Context, c *hkp.Client, args []string) error {
+	fs := newFlagSet("refresh")
+	maxDelay := fs.Duration("max-delay", 0, "")
+	format := fs.String("o", "armor", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if !isKeyFormat(*format) {
+		return errUsage
+	}
+
+	el, err := readKeys(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	results, err := hkp.Refresh(ctx, c, el, &hkp.RefreshOptions{MaxDelay: *maxDelay})
+	if err != nil {
+		return err
+	}
+
+	var failed error
+	for _, res := range results {
+		fpr := res.Entity.PrimaryKey.Fingerprint
+		if res.Err == hkp.ErrNotFound {
+			fmt.Fprintf(os.Stderr, "hkp: %X: not found\n", fpr)
+		} else if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "hkp: %X: %v\n", fpr, res.Err)
+			failed = res.Err
+		} else {
+			fmt.Fprintf(os.Stderr, "hkp: %X: %v\n", fpr, formatChanges(res.Changes))
+		}
+	}
+
+	if err := writeKeys(el, *format); err != nil {
+		return err
+	}
+	return failed
+}
+
+func runStats(ctx context.Context, c *hkp.Client, args []string) error {
+	fs := newFlagSet("stats")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	stats, err := c.StatsContext(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(stats.Body)
+	return err
+}
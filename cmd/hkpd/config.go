@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+// duration is a time.Duration encoded as a string in JSON, e.g. "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type listenConfig struct {
+	Addr string `json:"addr"`
+	TLS  bool   `json:"tls"`
+}
+
+type tlsConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type storageConfig struct {
+	// Type is either "memory" or "dir"
+	Type string `json:"type"`
+	Dir  string `json:"dir"`
+}
+
+type uploadConfig struct {
+	// Policy is one of "open", "authenticated" or "disabled"
+	Policy string `json:"policy"`
+	// Tokens maps bearer tokens to principal names
+	Tokens map[string]string `json:"tokens"`
+}
+
+type rateConfig struct {
+	Burst    int      `json:"burst"`
+	Interval duration `json:"interval"`
+}
+
+type rateLimitConfig struct {
+	Lookup         rateConfig `json:"lookup"`
+	Add            rateConfig `json:"add"`
+	TrustedProxies []string   `json:"trusted_proxies"`
+}
+
+type upstreamConfig struct {
+	Keyservers   []string `json:"keyservers"`
+	Timeout      duration `json:"timeout"`
+	WriteThrough bool     `json:"write_through"`
+}
+
+type logConfig struct {
+	// Format is either "text" or "json"
+	Format string `json:"format"`
+	// Level is one of "debug", "info", "warn" or "error"
+	Level string `json:"level"`
+}
+
+type config struct {
+	Listen          []listenConfig   `json:"listen"`
+	TLS             *tlsConfig       `json:"tls"`
+	Storage         storageConfig    `json:"storage"`
+	Upload          uploadConfig     `json:"upload"`
+	RateLimit       *rateLimitConfig `json:"rate_limit"`
+	Upstream        *upstreamConfig  `json:"upstream"`
+	CacheMaxAge     duration         `json:"cache_max_age"`
+	ShutdownTimeout duration         `json:"shutdown_timeout"`
+	Log             logConfig        `json:"log"`
+}
+
+func loadConfig(filename string) (*config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := config{
+		Listen:          []listenConfig{{Addr: ":11371"}},
+		Storage:         storageConfig{Type: "memory"},
+		Upload:          uploadConfig{Policy: "open"},
+		ShutdownTimeout: duration(30 * time.Second),
+		Log:             logConfig{Format: "text", Level: "info"},
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %v", filename, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %v", filename, err)
+	}
+	return &cfg, nil
+}
+
+func (cfg *config) validate() error {
+	if len(cfg.Listen) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	for _, l := range cfg.Listen {
+		if l.TLS && cfg.TLS == nil {
+			return fmt.Errorf("TLS listener %q requires a TLS certificate", l.Addr)
+		}
+	}
+
+	switch cfg.Storage.Type {
+	case "memory":
+		// No-op
+	case "dir":
+		if cfg.Storage.Dir == "" {
+			return fmt.Errorf("missing storage directory")
+		}
+	default:
+		return fmt.Errorf("unknown storage type %q", cfg.Storage.Type)
+	}
+
+	switch cfg.Upload.Policy {
+	case "open", "disabled":
+		// No-op
+	case "authenticated":
+		if len(cfg.Upload.Tokens) == 0 {
+			return fmt.Errorf("authenticated upload policy requires tokens")
+		}
+	default:
+		return fmt.Errorf("unknown upload policy %q", cfg.Upload.Policy)
+	}
+
+	if cfg.Upstream != nil {
+		for _, uri := range cfg.Upstream.Keyservers {
+			if _, err := hkp.ParseKeyserverURI(uri); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.RateLimit != nil {
+		for _, s := range cfg.RateLimit.TrustedProxies {
+			if _, err := netip.ParsePrefix(s); err != nil {
+				return fmt.Errorf("invalid trusted proxy network: %v", err)
+			}
+		}
+	}
+
+	switch cfg.Log.Format {
+	case "text", "json":
+		// No-op
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Log.Format)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		return fmt.Errorf("unknown log level %q", cfg.Log.Level)
+	}
+
+	return nil
+}
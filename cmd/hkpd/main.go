@@ -0,0 +1,356 @@
+// Command hkpd is an OpenPGP HTTP Keyserver Protocol (HKP) keyserver.
+//
+// Usage:
+//
+//	hkpd [-config hkpd.json]
+//
+// The configuration file is a JSON object. All fields are optional:
+//
+//	{
+//		"listen": [{"addr": ":11371"}, {"addr": ":443", "tls": true}],
+//		"tls": {"cert": "cert.pem", "key": "key.pem"},
+//		"storage": {"type": "dir", "dir": "/var/lib/hkpd"},
+//		"upload": {"policy": "authenticated", "tokens": {"s3cr3t": "alice"}},
+//		"rate_limit": {
+//			"lookup": {"burst": 20, "interval": "1s"},
+//			"add": {"burst": 5, "interval": "1m"},
+//			"trusted_proxies": ["127.0.0.1/32"]
+//		},
+//		"upstream": {
+//			"keyservers": ["hkps://keys.openpgp.org"],
+//			"timeout": "10s",
+//			"write_through": true
+//		},
+//		"cache_max_age": "5m",
+//		"shutdown_timeout": "30s",
+//		"log": {"format": "json", "level": "info"}
+//	}
+//
+// The storage type is either "memory" (the default) or "dir". The upload
+// policy is one of "open" (the default), "authenticated" or "disabled".
+//
+// On SIGHUP, the configuration file and the TLS certificate are reloaded.
+// Listen addresses and storage can't be changed without a restart. Rate limit
+// budgets are kept across reloads, unless the rate limit settings change. On
+// SIGINT or SIGTERM, the server stops accepting connections and waits for
+// pending requests to complete.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+// server holds the state which survives configuration reloads.
+type server struct {
+	logger  atomic.Pointer[slog.Logger]
+	store   *store
+	handler atomic.Pointer[http.Handler]
+	cert    atomic.Pointer[tls.Certificate]
+
+	// Only accessed from the main goroutine
+	rateLimiter     *hkp.RateLimiter
+	rateLimitConfig *rateLimitConfig
+}
+
+func (srv *server) log() *slog.Logger {
+	return srv.logger.Load()
+}
+
+// logHandler is a slog.Handler forwarding records to the current logger of a
+// server.
+type logHandler struct {
+	srv *server
+}
+
+func (h logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.srv.log().Enabled(ctx, level)
+}
+
+func (h logHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.srv.log().Handler().Handle(ctx, record)
+}
+
+// WithAttrs implements slog.Handler. The returned handler doesn't follow
+// configuration reloads.
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.srv.log().Handler().WithAttrs(attrs)
+}
+
+// WithGroup implements slog.Handler. The returned handler doesn't follow
+// configuration reloads.
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return h.srv.log().Handler().WithGroup(name)
+}
+
+func newLogger(cfg *logConfig) *slog.Logger {
+	// Already validated when loading the configuration
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Level))
+	options := slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	if cfg.Format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, &options)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, &options)
+	}
+	return slog.New(h)
+}
+
+func (srv *server) loadCertificate(cfg *config) error {
+	if cfg.TLS == nil {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	srv.cert.Store(&cert)
+	return nil
+}
+
+func (srv *server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := srv.cert.Load()
+	if cert == nil {
+		return nil, errors.New("no TLS certificate configured")
+	}
+	return cert, nil
+}
+
+func newRate(cfg *rateConfig) hkp.Rate {
+	return hkp.Rate{Burst: cfg.Burst, Interval: time.Duration(cfg.Interval)}
+}
+
+// newHandler creates an HTTP handler from the configuration.
+func (srv *server) newHandler(cfg *config) http.Handler {
+	h := hkp.Handler{
+		Lookuper:    srv.store,
+		CacheMaxAge: time.Duration(cfg.CacheMaxAge),
+	}
+
+	if cfg.Upstream != nil && len(cfg.Upstream.Keyservers) > 0 {
+		pl := hkp.ProxyLookuper{
+			Local:   srv.store,
+			Timeout: time.Duration(cfg.Upstream.Timeout),
+		}
+		for _, uri := range cfg.Upstream.Keyservers {
+			// Already validated when loading the configuration
+			c, _ := hkp.ParseKeyserverURI(uri)
+			pl.Upstreams = append(pl.Upstreams, c)
+		}
+		if cfg.Upstream.WriteThrough {
+			pl.WriteThrough = srv.store
+			pl.WriteThroughFailed = func(err error) {
+				srv.log().Warn("failed to store upstream keys", "err", err)
+			}
+		}
+		h.Lookuper = &pl
+	}
+
+	switch cfg.Upload.Policy {
+	case "open":
+		h.Adder = srv.store
+	case "authenticated":
+		h.Adder = srv.store
+		h.Authenticator = hkp.TokenAuthenticator(cfg.Upload.Tokens)
+	}
+
+	h.RateLimiter = srv.newRateLimiter(cfg.RateLimit)
+
+	return &h
+}
+
+// newRateLimiter returns the rate limiter for a configuration. The current
+// rate limiter is kept if the settings haven't changed, so that clients can't
+// reset their budget by waiting for a reload.
+func (srv *server) newRateLimiter(cfg *rateLimitConfig) *hkp.RateLimiter {
+	if cfg == nil {
+		srv.rateLimiter, srv.rateLimitConfig = nil, nil
+		return nil
+	}
+	if srv.rateLimiter != nil && reflect.DeepEqual(srv.rateLimitConfig, cfg) {
+		return srv.rateLimiter
+	}
+
+	rl := &hkp.RateLimiter{
+		Lookup: newRate(&cfg.Lookup),
+		Add:    newRate(&cfg.Add),
+	}
+	for _, s := range cfg.TrustedProxies {
+		// Already validated when loading the configuration
+		prefix, _ := netip.ParsePrefix(s)
+		rl.TrustedProxies = append(rl.TrustedProxies, prefix)
+	}
+	srv.rateLimiter, srv.rateLimitConfig = rl, cfg
+	return rl
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// ServeHTTP implements http.Handler. It forwards requests to the current
+// handler and logs them.
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	(*srv.handler.Load()).ServeHTTP(&rec, r)
+
+	srv.log().Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"op", r.URL.Query().Get("op"),
+		"status", rec.status,
+		"duration", time.Since(start),
+		"remote_addr", r.RemoteAddr,
+	)
+}
+
+// reload applies a new configuration.
+func (srv *server) reload(prev, cfg *config) error {
+	if err := srv.loadCertificate(cfg); err != nil {
+		return err
+	}
+
+	srv.logger.Store(newLogger(&cfg.Log))
+	if !reflect.DeepEqual(prev.Listen, cfg.Listen) {
+		srv.log().Warn("listen addresses can't be changed without a restart")
+	}
+	if prev.Storage != cfg.Storage {
+		srv.log().Warn("storage can't be changed without a restart")
+	}
+
+	h := srv.newHandler(cfg)
+	srv.handler.Store(&h)
+	return nil
+}
+
+func main() {
+	configFilename := flag.String("config", "hkpd.json", "configuration file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hkpd: %v\n", err)
+		os.Exit(1)
+	}
+
+	var srv server
+	srv.logger.Store(newLogger(&cfg.Log))
+	if err := srv.run(*configFilename, cfg); err != nil {
+		srv.log().Error("fatal error", "err", err)
+		os.Exit(1)
+	}
+}
+
+func (srv *server) run(configFilename string, cfg *config) error {
+	var err error
+	if cfg.Storage.Type == "dir" {
+		srv.store, err = newStore(cfg.Storage.Dir)
+	} else {
+		srv.store, err = newStore("")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %v", err)
+	}
+
+	if err := srv.loadCertificate(cfg); err != nil {
+		return err
+	}
+	h := srv.newHandler(cfg)
+	srv.handler.Store(&h)
+
+	var (
+		httpServers []*http.Server
+		wg          sync.WaitGroup
+		errCh       = make(chan error, len(cfg.Listen))
+	)
+	for _, l := range cfg.Listen {
+		httpServer := &http.Server{
+			Addr:              l.Addr,
+			Handler:           srv,
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          slog.NewLogLogger(logHandler{srv}, slog.LevelWarn),
+		}
+		if l.TLS {
+			httpServer.TLSConfig = &tls.Config{GetCertificate: srv.getCertificate}
+		}
+		httpServers = append(httpServers, httpServer)
+
+		wg.Add(1)
+		go func(l listenConfig) {
+			defer wg.Done()
+			srv.log().Info("listening", "addr", l.Addr, "tls", l.TLS)
+			var err error
+			if l.TLS {
+				err = httpServer.ListenAndServeTLS("", "")
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("failed to serve on %q: %v", l.Addr, err)
+			}
+		}(l)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	var runErr error
+loop:
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				srv.log().Info("shutting down", "signal", sig.String())
+				break loop
+			}
+
+			newCfg, err := loadConfig(configFilename)
+			if err == nil {
+				err = srv.reload(cfg, newCfg)
+			}
+			if err != nil {
+				srv.log().Error("failed to reload configuration", "err", err)
+				continue
+			}
+			cfg = newCfg
+			srv.log().Info("configuration reloaded")
+		case runErr = <-errCh:
+			break loop
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			srv.log().Warn("failed to shut down gracefully", "addr", httpServer.Addr, "err", err)
+		}
+	}
+	wg.Wait()
+
+	return runErr
+}
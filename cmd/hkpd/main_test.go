@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	filename := filepath.Join(t.TempDir(), "hkpd.json")
+	if err := os.WriteFile(filename, []byte(s), 0600); err != nil {
+		t.Fatalf("os.WriteFile(): %v", err)
+	}
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `{}`))
+	if err != nil {
+		t.Fatalf("loadConfig(): %v", err)
+	}
+	if len(cfg.Listen) != 1 || cfg.Listen[0].Addr != ":11371" {
+		t.Errorf("default listen addresses = %v, want [:11371]", cfg.Listen)
+	}
+	if cfg.Storage.Type != "memory" || cfg.Upload.Policy != "open" || cfg.Log.Format != "text" {
+		t.Errorf("loadConfig() returned unexpected defaults: %+v", cfg)
+	}
+	if time.Duration(cfg.ShutdownTimeout) != 30*time.Second {
+		t.Errorf("default shutdown timeout = %v, want %v", time.Duration(cfg.ShutdownTimeout), 30*time.Second)
+	}
+
+	cfg, err = loadConfig(writeConfig(t, `{
+		"listen": [{"addr": ":443", "tls": true}],
+		"tls": {"cert": "cert.pem", "key": "key.pem"},
+		"storage": {"type": "dir", "dir": "/var/lib/hkpd"},
+		"upload": {"policy": "authenticated", "tokens": {"s3cr3t": "alice"}},
+		"rate_limit": {
+			"lookup": {"burst": 20, "interval": "1s"},
+			"trusted_proxies": ["127.0.0.1/32"]
+		},
+		"upstream": {"keyservers": ["hkps://keys.openpgp.org"], "timeout": "10s"},
+		"cache_max_age": "5m",
+		"log": {"format": "json", "level": "debug"}
+	}`))
+	if err != nil {
+		t.Fatalf("loadConfig(): %v", err)
+	}
+	if cfg.Storage.Dir != "/var/lib/hkpd" || cfg.Upload.Tokens["s3cr3t"] != "alice" {
+		t.Errorf("loadConfig() = %+v, missing settings", cfg)
+	}
+	if cfg.RateLimit == nil || cfg.RateLimit.Lookup.Burst != 20 || time.Duration(cfg.RateLimit.Lookup.Interval) != time.Second {
+		t.Errorf("loadConfig(): got rate limit %+v", cfg.RateLimit)
+	}
+	if time.Duration(cfg.CacheMaxAge) != 5*time.Minute {
+		t.Errorf("loadConfig(): got cache max age %v, want %v", time.Duration(cfg.CacheMaxAge), 5*time.Minute)
+	}
+
+	invalid := []string{
+		`{"listen": []}`,
+		`{"listen": [{"addr": ":443", "tls": true}]}`,
+		`{"storage": {"type": "dir"}}`,
+		`{"storage": {"type": "sql"}}`,
+		`{"upload": {"policy": "authenticated"}}`,
+		`{"upload": {"policy": "closed"}}`,
+		`{"upstream": {"keyservers": ["ldap://keys.example.org"]}}`,
+		`{"rate_limit": {"trusted_proxies": ["localhost"]}}`,
+		`{"log": {"format": "xml"}}`,
+		`{"log": {"level": "verbose"}}`,
+		`{"cache_max_age": "5 minutes"}`,
+		`{"listen": `,
+	}
+	for _, s := range invalid {
+		if _, err := loadConfig(writeConfig(t, s)); err == nil {
+			t.Errorf("loadConfig(%v): want error", s)
+		}
+	}
+}
+
+func newTestEntity(t *testing.T) *openpgp.Entity {
+	config := packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	e, err := openpgp.NewEntity("", "", "alice@example.org", &config)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity(): %v", err)
+	}
+	if err := e.AddUserId("", "", "alice@example.com", nil); err != nil {
+		t.Fatalf("Entity.AddUserId(): %v", err)
+	}
+	return e
+}
+
+// publicEntity returns a copy of the public part of an entity.
+func publicEntity(t *testing.T, e *openpgp.Entity) *openpgp.Entity {
+	var b bytes.Buffer
+	if err := e.Serialize(&b); err != nil {
+		t.Fatalf("Entity.Serialize(): %v", err)
+	}
+	pub, err := openpgp.ReadEntity(packet.NewReader(&b))
+	if err != nil {
+		t.Fatalf("openpgp.ReadEntity(): %v", err)
+	}
+	return pub
+}
+
+func TestStore_add(t *testing.T) {
+	dir := t.TempDir()
+	st, err := newStore(dir)
+	if err != nil {
+		t.Fatalf("newStore(): %v", err)
+	}
+
+	e := newTestEntity(t)
+	if err := st.Add(openpgp.EntityList{publicEntity(t, e)}); err != nil {
+		t.Fatalf("store.Add(): %v", err)
+	}
+
+	// Uploading a stripped copy must not remove identities
+	stripped := publicEntity(t, e)
+	delete(stripped.Identities, "<alice@example.com>")
+	if err := st.Add(openpgp.EntityList{stripped}); err != nil {
+		t.Fatalf("store.Add(): %v", err)
+	}
+
+	// Revocations are merged
+	if err := e.RevokeKey(packet.KeyCompromised, "", nil); err != nil {
+		t.Fatalf("Entity.RevokeKey(): %v", err)
+	}
+	if err := st.Add(openpgp.EntityList{publicEntity(t, e)}); err != nil {
+		t.Fatalf("store.Add(): %v", err)
+	}
+
+	req := hkp.LookupRequest{Search: "alice@example.org"}
+	for _, st := range []*store{st, mustNewStore(t, dir)} {
+		el, err := st.Get(&req)
+		if err != nil {
+			t.Fatalf("store.Get(): %v", err)
+		} else if len(el) != 1 {
+			t.Fatalf("store.Get(): got %v keys, want 1", len(el))
+		}
+		if len(el[0].Identities) != 2 {
+			t.Errorf("store.Get(): got %v identities, want 2", len(el[0].Identities))
+		}
+		if !el[0].Revoked(time.Now()) {
+			t.Errorf("store.Get(): key isn't revoked")
+		}
+	}
+}
+
+func TestStore_concurrentLookups(t *testing.T) {
+	st, err := newStore("")
+	if err != nil {
+		t.Fatalf("newStore(): %v", err)
+	}
+	e := newTestEntity(t)
+	if err := st.Add(openpgp.EntityList{publicEntity(t, e)}); err != nil {
+		t.Fatalf("store.Add(): %v", err)
+	}
+
+	h := hkp.Handler{Lookuper: st, Adder: st}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		upload := publicEntity(t, e)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pks/lookup?op=get&search=alice@example.org", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("lookup: got status %v, want %v", w.Code, http.StatusOK)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := st.Add(openpgp.EntityList{upload}); err != nil {
+				t.Errorf("store.Add(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func mustNewStore(t *testing.T, dir string) *store {
+	st, err := newStore(dir)
+	if err != nil {
+		t.Fatalf("newStore(): %v", err)
+	}
+	return st
+}
+
+func TestServer_reload(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `{
+		"rate_limit": {"lookup": {"burst": 1, "interval": "1h"}},
+		"log": {"level": "error"}
+	}`))
+	if err != nil {
+		t.Fatalf("loadConfig(): %v", err)
+	}
+
+	var srv server
+	srv.logger.Store(newLogger(&cfg.Log))
+	if srv.store, err = newStore(""); err != nil {
+		t.Fatalf("newStore(): %v", err)
+	}
+	h := srv.newHandler(cfg)
+	srv.handler.Store(&h)
+
+	lookup := func() int {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pks/lookup?op=get&search=alice@example.org", nil))
+		return w.Code
+	}
+
+	if code := lookup(); code != http.StatusNotFound {
+		t.Fatalf("first lookup: got status %v, want %v", code, http.StatusNotFound)
+	}
+	if code := lookup(); code != http.StatusTooManyRequests {
+		t.Fatalf("second lookup: got status %v, want %v", code, http.StatusTooManyRequests)
+	}
+
+	newCfg, err := loadConfig(writeConfig(t, `{
+		"rate_limit": {"lookup": {"burst": 1, "interval": "1h"}},
+		"log": {"level": "debug"}
+	}`))
+	if err != nil {
+		t.Fatalf("loadConfig(): %v", err)
+	}
+	if err := srv.reload(cfg, newCfg); err != nil {
+		t.Fatalf("server.reload(): %v", err)
+	}
+
+	if code := lookup(); code != http.StatusTooManyRequests {
+		t.Errorf("lookup after reload: got status %v, want %v", code, http.StatusTooManyRequests)
+	}
+	if !srv.log().Enabled(context.Background(), slog.LevelDebug) {
+		t.Errorf("log level wasn't reloaded")
+	}
+}
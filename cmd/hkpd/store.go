@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+
+	"github.com/emersion/go-openpgp-hkp"
+)
+
+// store is a backend keeping keys in memory. If dir is set, keys are also
+// saved in this directory, one file per key, and loaded on startup.
+//
+// Serializing an entity modifies its signatures, so stored entities are never
+// handed out: each lookup gets its own copy parsed from the serialized key.
+type store struct {
+	dir string
+
+	mutex sync.RWMutex
+	keys  map[string]*storedKey // by fingerprint
+}
+
+type storedKey struct {
+	// entity is only read, to match searches and build indexes
+	entity *openpgp.Entity
+	data   []byte
+}
+
+// newStoredKey serializes an entity. The stored entity is parsed back, so
+// that it doesn't share packets with e.
+func newStoredKey(e *openpgp.Entity) (*storedKey, error) {
+	var b bytes.Buffer
+	if err := e.Serialize(&b); err != nil {
+		return nil, err
+	}
+	k := &storedKey{data: b.Bytes()}
+	var err error
+	if k.entity, err = k.parse(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// parse returns a new copy of the stored entity.
+func (k *storedKey) parse() (*openpgp.Entity, error) {
+	return openpgp.ReadEntity(packet.NewReader(bytes.NewReader(k.data)))
+}
+
+var (
+	_ hkp.Lookuper = (*store)(nil)
+	_ hkp.Adder    = (*store)(nil)
+)
+
+func newStore(dir string) (*store, error) {
+	st := &store{
+		dir:  dir,
+		keys: make(map[string]*storedKey),
+	}
+	if dir == "" {
+		return st, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.pgp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		el, err := openpgp.ReadKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %q: %v", filename, err)
+		}
+		for _, e := range el {
+			k, err := newStoredKey(e)
+			if err != nil {
+				return nil, err
+			}
+			st.keys[string(e.PrimaryKey.Fingerprint)] = k
+		}
+	}
+
+	return st, nil
+}
+
+func (st *store) save(k *storedKey) error {
+	if st.dir == "" {
+		return nil
+	}
+
+	filename := filepath.Join(st.dir, strings.ToUpper(hex.EncodeToString(k.entity.PrimaryKey.Fingerprint))+".pgp")
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, k.data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func matchesKeyID(e *openpgp.Entity, search hkp.KeyIDSearch) bool {
+	if fingerprint := search.Fingerprint(); fingerprint != nil {
+		return bytes.Equal(e.PrimaryKey.Fingerprint, fingerprint)
+	} else if keyID := search.KeyId(); keyID != nil {
+		return e.PrimaryKey.KeyId == *keyID
+	} else if keyID := search.KeyIdShort(); keyID != nil {
+		return uint32(e.PrimaryKey.KeyId) == *keyID
+	}
+	return false
+}
+
+func matchesIdentity(e *openpgp.Entity, search string, exact bool) bool {
+	search = strings.ToLower(search)
+	for name, ident := range e.Identities {
+		name = strings.ToLower(name)
+		email := strings.ToLower(ident.UserId.Email)
+		if exact && (name == search || email == search) {
+			return true
+		} else if !exact && strings.Contains(name, search) {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *store) search(req *hkp.LookupRequest) []*storedKey {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	keyIDSearch := hkp.ParseKeyIDSearch(req.Search)
+
+	var res []*storedKey
+	for _, k := range st.keys {
+		e := k.entity
+		if keyIDSearch != nil && matchesKeyID(e, keyIDSearch) || keyIDSearch == nil && matchesIdentity(e, req.Search, req.Exact) {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// Get implements hkp.Lookuper.
+func (st *store) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
+	var el openpgp.EntityList
+	for _, k := range st.search(req) {
+		e, err := k.parse()
+		if err != nil {
+			return nil, err
+		}
+		el = append(el, e)
+	}
+	if len(el) == 0 {
+		return nil, hkp.ErrNotFound
+	}
+	return el, nil
+}
+
+// Index implements hkp.Lookuper.
+func (st *store) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
+	var keys []hkp.IndexKey
+	for _, k := range st.search(req) {
+		key, err := hkp.IndexKeyFromEntity(k.entity)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	if len(keys) == 0 {
+		return nil, hkp.ErrNotFound
+	}
+	return keys, nil
+}
+
+// Add implements hkp.Adder. Keys which are already known are merged with the
+// stored ones, so that signatures such as revocations can't be removed.
+func (st *store) Add(el openpgp.EntityList) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for _, e := range el {
+		fpr := string(e.PrimaryKey.Fingerprint)
+		if existing, ok := st.keys[fpr]; ok {
+			// Stored entities may be in use by concurrent lookups, so
+			// merge into a copy
+			merged, err := existing.parse()
+			if err != nil {
+				return err
+			}
+			hkp.MergeEntity(merged, e)
+			e = merged
+		}
+		k, err := newStoredKey(e)
+		if err != nil {
+			return err
+		}
+		if err := st.save(k); err != nil {
+			return err
+		}
+		st.keys[fpr] = k
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package hkp
+
+import (
+	"fmt"
+
+	"github.com/ProtonMail/go-crypto/openpgp/ecdh"
+	"github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+type curveInfo struct {
+	name      string
+	oid       string
+	bitLength int
+}
+
+// curves maps the curve names used by go-crypto to curve information. Names
+// in curveInfo are the ones used by GnuPG.
+var curves = map[string]curveInfo{
+	"P-256":           {"nistp256", "1.2.840.10045.3.1.7", 256},
+	"P-384":           {"nistp384", "1.3.132.0.34", 384},
+	"P-521":           {"nistp521", "1.3.132.0.35", 521},
+	"secp256k1":       {"secp256k1", "1.3.132.0.10", 256},
+	"brainpoolP256r1": {"brainpoolP256r1", "1.3.36.3.3.2.8.1.1.7", 256},
+	"brainpoolP384r1": {"brainpoolP384r1", "1.3.36.3.3.2.8.1.1.11", 384},
+	"brainpoolP512r1": {"brainpoolP512r1", "1.3.36.3.3.2.8.1.1.13", 512},
+	"curve25519":      {"cv25519", "1.3.6.1.4.1.3029.1.5.1", 255},
+	"ed25519":         {"ed25519", "1.3.6.1.4.1.11591.15.1", 255},
+	"x448":            {"cv448", "1.3.101.111", 448},
+	"ed448":           {"ed448", "1.3.101.113", 448},
+}
+
+func isECCAlgo(algo packet.PublicKeyAlgorithm) bool {
+	switch algo {
+	case packet.PubKeyAlgoECDH, packet.PubKeyAlgoECDSA, packet.PubKeyAlgoEdDSA:
+		return true
+	default:
+		return false
+	}
+}
+
+// publicKeyCurve returns the elliptic curve used by an ECC public key. It
+// returns nil for other kinds of keys.
+func publicKeyCurve(pk *packet.PublicKey) (*curveInfo, error) {
+	if !isECCAlgo(pk.PubKeyAlgo) {
+		return nil, nil
+	}
+
+	var name string
+	switch k := pk.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		name = k.GetCurve().GetCurveName()
+	case *ecdh.PublicKey:
+		name = k.GetCurve().GetCurveName()
+	case *eddsa.PublicKey:
+		name = k.GetCurve().GetCurveName()
+	default:
+		return nil, fmt.Errorf("hkp: malformed %v public key", pk.PubKeyAlgo)
+	}
+
+	curve, ok := curves[name]
+	if !ok {
+		return nil, fmt.Errorf("hkp: unknown curve %q", name)
+	}
+	return &curve, nil
+}
+
+func curveByName(name string) *curveInfo {
+	for _, curve := range curves {
+		if curve.name == name {
+			return &curve
+		}
+	}
+	return nil
+}
+
+// formatAlgo returns a human-readable algorithm string, in the style of
+// GnuPG: "rsa4096", "dsa2048", "ed25519", "nistp256" and so on.
+func formatAlgo(algo packet.PublicKeyAlgorithm, bitLength int, curve string) string {
+	if curve != "" {
+		return curve
+	}
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		return fmt.Sprintf("rsa%d", bitLength)
+	case packet.PubKeyAlgoDSA:
+		return fmt.Sprintf("dsa%d", bitLength)
+	case packet.PubKeyAlgoElGamal:
+		return fmt.Sprintf("elg%d", bitLength)
+	case packet.PubKeyAlgoECDH:
+		return "ecdh"
+	case packet.PubKeyAlgoECDSA:
+		return "ecdsa"
+	case packet.PubKeyAlgoEdDSA:
+		return "eddsa"
+	default:
+		return fmt.Sprintf("unknown%d", algo)
+	}
+}
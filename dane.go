@@ -0,0 +1,479 @@
+package hkp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// OPENPGPKEY DNS resource record type, defined in RFC 7929.
+const dnsTypeOpenPGPKey = 61
+
+const (
+	dnsTypeCNAME = 5
+	dnsTypeOPT   = 41
+	dnsClassINET = 1
+
+	dnsFlagQR = 1 << 15
+	dnsFlagRD = 1 << 8
+	dnsFlagAD = 1 << 5
+	dnsFlagTC = 1 << 9
+
+	dnsRcodeNXDomain = 3
+
+	// EDNS(0) UDP payload size, large enough for most keys
+	dnsUDPSize = 4096
+)
+
+// OpenPGPKeyName returns the DNS owner name of the OPENPGPKEY record for an
+// email address, as defined in RFC 7929 section 3. The local part is hashed
+// as-is.
+func OpenPGPKeyName(email string) (string, error) {
+	i := strings.LastIndexByte(email, '@')
+	if i <= 0 || i == len(email)-1 {
+		return "", fmt.Errorf("hkp: invalid email address %q", email)
+	}
+	localPart, domain := email[:i], email[i+1:]
+
+	sum := sha256.Sum256([]byte(localPart))
+	return hex.EncodeToString(sum[:28]) + "._openpgpkey." + strings.TrimSuffix(strings.ToLower(domain), "."), nil
+}
+
+// DANEClient fetches OpenPGP keys published in DNS OPENPGPKEY records (RFC
+// 7929).
+//
+// Records are only as trustworthy as the DNS resolver. A validating resolver
+// should be used, with RequireAuthenticated set.
+type DANEClient struct {
+	// Server is the address of the DNS server, e.g. "127.0.0.1:53". If
+	// empty, the first name server in /etc/resolv.conf is used: on systems
+	// without this file, such as Windows, Server must be set.
+	Server string
+	// Timeout is the maximum duration of a lookup. If zero, a default of 5
+	// seconds is used.
+	Timeout time.Duration
+	// RequireAuthenticated rejects responses which haven't been validated
+	// with DNSSEC by the resolver (AD flag).
+	RequireAuthenticated bool
+	// Dial connects to the DNS server. If nil, net.Dialer is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// defaultDNSServer returns the first name server listed in /etc/resolv.conf.
+func defaultDNSServer() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("hkp: failed to find DNS server: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("hkp: no DNS server found in /etc/resolv.conf")
+}
+
+// Get looks up the keys published for an email address.
+func (c *DANEClient) Get(email string) (openpgp.EntityList, error) {
+	return c.GetContext(context.Background(), email)
+}
+
+// GetContext is like Get, but with a context.
+func (c *DANEClient) GetContext(ctx context.Context, email string) (openpgp.EntityList, error) {
+	name, err := OpenPGPKeyName(email)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	records, err := c.query(ctx, name, dnsTypeOpenPGPKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var el openpgp.EntityList
+	for _, rdata := range records {
+		keys, err := openpgp.ReadKeyRing(bytes.NewReader(rdata))
+		if err != nil {
+			return nil, fmt.Errorf("hkp: invalid OPENPGPKEY record for %q: %v", email, err)
+		}
+		el = append(el, keys...)
+	}
+	if len(el) == 0 {
+		return nil, ErrNotFound
+	}
+	return el, nil
+}
+
+func (c *DANEClient) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx, network, addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// query sends a DNS query and returns the data of the records of the
+// requested type. The query is sent over UDP, and retried over TCP if the
+// response is truncated.
+func (c *DANEClient) query(ctx context.Context, name string, typ uint16) ([][]byte, error) {
+	server := c.Server
+	if server == "" {
+		var err error
+		if server, err = defaultDNSServer(); err != nil {
+			return nil, err
+		}
+	}
+
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+
+	req, err := newDNSQuery(id, name, typ)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.exchange(ctx, "udp", server, req)
+	if err == nil && len(resp) >= 4 && binary.BigEndian.Uint16(resp[2:])&dnsFlagTC != 0 {
+		resp, err = c.exchange(ctx, "tcp", server, req)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("hkp: DNS query failed: %v", err)
+	}
+
+	records, err := parseDNSResponse(resp, id, name, typ, c.RequireAuthenticated)
+	if err != nil && err != ErrNotFound {
+		return nil, fmt.Errorf("hkp: invalid DNS response: %v", err)
+	}
+	return records, err
+}
+
+func (c *DANEClient) exchange(ctx context.Context, network, server string, req []byte) ([]byte, error) {
+	conn, err := c.dial(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(req)))
+	msg = append(msg, req...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// newDNSQuery builds a recursive DNS query with an EDNS(0) OPT record.
+func newDNSQuery(id uint16, name string, typ uint16) ([]byte, error) {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, dnsFlagRD|dnsFlagAD)
+	b = binary.BigEndian.AppendUint16(b, 1) // QDCOUNT
+	b = binary.BigEndian.AppendUint16(b, 0) // ANCOUNT
+	b = binary.BigEndian.AppendUint16(b, 0) // NSCOUNT
+	b = binary.BigEndian.AppendUint16(b, 1) // ARCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("hkp: invalid DNS name %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, dnsClassINET)
+
+	// OPT pseudo-record: root name, type, UDP payload size, TTL, RDLENGTH
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+	b = binary.BigEndian.AppendUint16(b, dnsUDPSize)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+
+	return b, nil
+}
+
+// maxDNSPointers is the maximum number of compression pointers followed when
+// reading a name, to avoid loops.
+const maxDNSPointers = 16
+
+// readDNSName reads a possibly compressed name. It returns the name without
+// the trailing dot, and the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var (
+		labels   []string
+		next     = -1
+		pointers = 0
+	)
+	for {
+		if off >= len(msg) {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return "", 0, io.ErrUnexpectedEOF
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			pointers++
+			if pointers > maxDNSPointers {
+				return "", 0, errors.New("too many compression pointers")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			continue
+		case l&0xC0 != 0:
+			return "", 0, fmt.Errorf("invalid label length %v", l)
+		}
+		if off+1+l > len(msg) {
+			return "", 0, io.ErrUnexpectedEOF
+		}
+		labels = append(labels, string(msg[off+1:off+1+l]))
+		off += 1 + l
+	}
+}
+
+// equalDNSNames compares two names, ignoring ASCII case and trailing dots.
+func equalDNSNames(a, b string) bool {
+	a, b = strings.TrimSuffix(a, "."), strings.TrimSuffix(b, ".")
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		ca, cb := a[i], b[i]
+		if 'A' <= ca && ca <= 'Z' {
+			ca += 'a' - 'A'
+		}
+		if 'A' <= cb && cb <= 'Z' {
+			cb += 'a' - 'A'
+		}
+		if ca != cb {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDNSResponse parses the response to a query and returns the data of the
+// records of the requested type. The question must match the query, and only
+// answers for the queried name, or for the targets of CNAME records leading to
+// it, are returned.
+func parseDNSResponse(msg []byte, id uint16, name string, typ uint16, requireAD bool) ([][]byte, error) {
+	if len(msg) < 12 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint16(msg) != id {
+		return nil, errors.New("mismatched ID")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&dnsFlagQR == 0 {
+		return nil, errors.New("not a response")
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	if qdcount != 1 {
+		return nil, fmt.Errorf("got %v questions, want 1", qdcount)
+	}
+	qname, off, err := readDNSName(msg, 12)
+	if err != nil {
+		return nil, err
+	}
+	if off+4 > len(msg) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	qtype := binary.BigEndian.Uint16(msg[off:])
+	qclass := binary.BigEndian.Uint16(msg[off+2:])
+	if !equalDNSNames(qname, name) || qtype != typ || qclass != dnsClassINET {
+		return nil, errors.New("mismatched question")
+	}
+	off += 4
+
+	switch rcode := flags & 0xF; rcode {
+	case 0:
+		// OK
+	case dnsRcodeNXDomain:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("error code %v", rcode)
+	}
+	if requireAD && flags&dnsFlagAD == 0 {
+		return nil, errors.New("response isn't authenticated with DNSSEC")
+	}
+
+	owner := name
+	var records [][]byte
+	for i := 0; i < ancount; i++ {
+		var rrName string
+		rrName, off, err = readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rrClass := binary.BigEndian.Uint16(msg[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rdata := msg[off : off+rdlen]
+		rdataOff := off
+		off += rdlen
+
+		if rrClass != dnsClassINET || !equalDNSNames(rrName, owner) {
+			continue
+		}
+		switch rrType {
+		case typ:
+			records = append(records, rdata)
+		case dnsTypeCNAME:
+			// Answers may contain CNAME records leading to the
+			// requested ones. The target may be compressed, so it's
+			// read from the whole message.
+			target, end, err := readDNSName(msg, rdataOff)
+			if err != nil {
+				return nil, err
+			} else if end > off {
+				return nil, errors.New("invalid CNAME record")
+			}
+			owner = target
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return records, nil
+}
+
+// isZoneName reports whether a DNS name can be written as-is in a zone file.
+func isZoneName(name string) bool {
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for _, ch := range label {
+			ok := ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '_'
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// WriteOpenPGPKeyRecords writes OPENPGPKEY resource records for the email
+// addresses of a list of entities, in the zone file format. Each record
+// contains the primary key, the subkeys and the matching user ID only, as
+// recommended by RFC 7929 section 2.1.
+//
+// User IDs are chosen by key owners: only addresses in domain or one of its
+// subdomains are written, others are skipped.
+func WriteOpenPGPKeyRecords(w io.Writer, el openpgp.EntityList, domain string) error {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if !isZoneName(domain) {
+		return fmt.Errorf("hkp: invalid domain %q", domain)
+	}
+
+	for _, e := range el {
+		names := make([]string, 0, len(e.Identities))
+		for name := range e.Identities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			ident := e.Identities[name]
+			if ident.UserId == nil || ident.UserId.Email == "" {
+				continue
+			}
+
+			owner, err := OpenPGPKeyName(ident.UserId.Email)
+			if err != nil {
+				return err
+			}
+			if !strings.HasSuffix(owner, "."+domain) || !isZoneName(owner) {
+				continue
+			}
+
+			minimal := *e
+			minimal.Identities = map[string]*openpgp.Identity{name: ident}
+			var b bytes.Buffer
+			if err := minimal.Serialize(&b); err != nil {
+				return err
+			}
+
+			// The user ID is quoted, so that it can't span multiple lines
+			_, err = fmt.Fprintf(w, "; %+q\n%v. IN OPENPGPKEY %v\n", name, owner, base64.StdEncoding.EncodeToString(b.Bytes()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package hkp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultGnuPGKeyserver is the keyserver used by GnuPG when none is
+// configured.
+const defaultGnuPGKeyserver = "hkps://keys.openpgp.org"
+
+// GnuPGConfig contains the keyserver configuration of GnuPG, read from
+// dirmngr.conf and gpg.conf.
+type GnuPGConfig struct {
+	// Keyservers is the list of configured keyserver URIs. Keyservers from
+	// dirmngr.conf take precedence over the ones from gpg.conf.
+	Keyservers []string
+	// CACertFiles is the list of files containing additional root
+	// certificates for hkps keyservers (hkp-cacert).
+	CACertFiles []string
+	// HonorHTTPProxy enables the use of the http_proxy environment variable
+	// (honor-http-proxy).
+	HonorHTTPProxy bool
+	// HTTPProxy is the proxy URL to use for all requests (http-proxy).
+	HTTPProxy string
+	// UseTor indicates that all network access should go through the local
+	// Tor daemon, with stream isolation (use-tor).
+	UseTor bool
+}
+
+// GnuPGHome returns the GnuPG home directory: the value of the GNUPGHOME
+// environment variable if set, otherwise ~/.gnupg.
+func GnuPGHome() (string, error) {
+	if dir := os.Getenv("GNUPGHOME"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gnupg"), nil
+}
+
+// LoadGnuPGConfig reads the GnuPG configuration from the home directory
+// returned by GnuPGHome.
+func LoadGnuPGConfig() (*GnuPGConfig, error) {
+	dir, err := GnuPGHome()
+	if err != nil {
+		return nil, err
+	}
+	return ReadGnuPGConfig(dir)
+}
+
+// ReadGnuPGConfig reads dirmngr.conf and gpg.conf from a GnuPG home
+// directory. Missing files are ignored. If no keyserver is configured, the
+// GnuPG default is used.
+func ReadGnuPGConfig(dir string) (*GnuPGConfig, error) {
+	var cfg GnuPGConfig
+
+	var gpgKeyservers []string
+	err := readGnuPGConfigFile(filepath.Join(dir, "gpg.conf"), func(name, value string) {
+		switch name {
+		case "keyserver":
+			gpgKeyservers = append(gpgKeyservers, value)
+		case "keyserver-options":
+			for _, opt := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+				switch {
+				case opt == "honor-http-proxy":
+					cfg.HonorHTTPProxy = true
+				case opt == "no-honor-http-proxy":
+					cfg.HonorHTTPProxy = false
+				case strings.HasPrefix(opt, "http-proxy="):
+					cfg.HTTPProxy = strings.TrimPrefix(opt, "http-proxy=")
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readGnuPGConfigFile(filepath.Join(dir, "dirmngr.conf"), func(name, value string) {
+		switch name {
+		case "keyserver":
+			cfg.Keyservers = append(cfg.Keyservers, value)
+		case "hkp-cacert":
+			cfg.CACertFiles = append(cfg.CACertFiles, value)
+		case "honor-http-proxy":
+			cfg.HonorHTTPProxy = true
+		case "http-proxy":
+			cfg.HTTPProxy = value
+		case "use-tor":
+			cfg.UseTor = true
+		case "no-use-tor":
+			cfg.UseTor = false
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Keyservers) == 0 {
+		cfg.Keyservers = gpgKeyservers
+	}
+	if len(cfg.Keyservers) == 0 {
+		cfg.Keyservers = []string{defaultGnuPGKeyserver}
+	}
+
+	return &cfg, nil
+}
+
+// readGnuPGConfigFile parses a GnuPG configuration file. Each line contains
+// an option name, optionally followed by a value. Empty lines and lines
+// starting with "#" are ignored.
+func readGnuPGConfigFile(filename string, f func(name, value string)) error {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name, value = line[:i], line[i+1:]
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+
+		f(name, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("hkp: failed to read %q: %v", filename, err)
+	}
+	return nil
+}
+
+// httpClient creates an HTTP client according to the configuration.
+func (cfg *GnuPGConfig) httpClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// Like dirmngr, ignore the http_proxy environment variable by default
+	transport.Proxy = nil
+	if cfg.HTTPProxy != "" {
+		u, err := url.Parse(cfg.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("hkp: invalid HTTP proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	} else if cfg.HonorHTTPProxy {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+
+	if len(cfg.CACertFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, filename := range cfg.CACertFiles {
+			b, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			// Like dirmngr, accept both PEM and DER
+			if !pool.AppendCertsFromPEM(b) {
+				cert, err := x509.ParseCertificate(b)
+				if err != nil {
+					return nil, fmt.Errorf("hkp: no certificate found in %q", filename)
+				}
+				pool.AddCert(cert)
+			}
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = new(tls.Config)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// Clients creates a Client for each configured keyserver. The clients
+// share an HTTP client configured with the CA certificates and proxy
+// settings. If UseTor is set, the clients connect through DefaultTorProxy.
+func (cfg *GnuPGConfig) Clients() ([]*Client, error) {
+	httpClient, err := cfg.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*Client, len(cfg.Keyservers))
+	for i, uri := range cfg.Keyservers {
+		c, err := ParseKeyserverURI(uri)
+		if err != nil {
+			return nil, err
+		}
+		c.HTTPClient = httpClient
+		if cfg.UseTor {
+			c.SOCKSProxy = DefaultTorProxy
+			c.IsolateStreams = true
+		}
+		clients[i] = c
+	}
+	return clients, nil
+}
@@ -3,6 +3,7 @@
 package hkp
 
 import (
+	"bufio"
 	"encoding/binary"
 	"encoding/hex"
 	"io"
@@ -20,8 +21,17 @@ const (
 	addPath    = Base + "/add"
 )
 
+// hkpPort is the default port of hkp:// keyservers.
+const hkpPort = "11371"
+
 type LookupOptions struct {
 	NoModification bool
+	// JSON requests a JSON index instead of the colon-delimited
+	// machine-readable format. This is an extension to HKP.
+	JSON bool
+	// Binary requests keys in binary form instead of ASCII-armored. This is
+	// an extension to HKP.
+	Binary bool
 }
 
 func (opts *LookupOptions) format() string {
@@ -30,6 +40,12 @@ func (opts *LookupOptions) format() string {
 	if opts.NoModification {
 		l = append(l, "nm")
 	}
+	if opts.JSON {
+		l = append(l, "json")
+	}
+	if opts.Binary {
+		l = append(l, "binary")
+	}
 	return strings.Join(l, ",")
 }
 
@@ -39,6 +55,10 @@ func parseLookupOptions(s string) *LookupOptions {
 		switch opt {
 		case "nm":
 			opts.NoModification = true
+		case "json":
+			opts.JSON = true
+		case "binary":
+			opts.Binary = true
 		}
 	}
 	return &opts
@@ -57,15 +77,47 @@ func serializeArmoredKeyRing(w io.Writer, el openpgp.EntityList) error {
 	}
 	defer aw.Close()
 
+	return serializeKeyRing(aw, el)
+}
+
+// keysMediaType is the media type of ASCII-armored keys.
+const keysMediaType = "application/pgp-keys"
+
+// binaryMediaType is the media type of keys in binary form. It can be listed
+// in the Accept header of lookup requests to retrieve keys in binary form.
+const binaryMediaType = keysMediaType + "; encoding=binary"
+
+func serializeKeyRing(w io.Writer, el openpgp.EntityList) error {
 	for _, e := range el {
-		if err := e.Serialize(aw); err != nil {
+		if err := e.Serialize(w); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
+// readKeyRing reads a binary or ASCII-armored key ring.
+func readKeyRing(r io.Reader) (openpgp.EntityList, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.ReadByte()
+	}
+
+	// OpenPGP packets always have the most significant bit of their tag set,
+	// while ASCII armor starts with a dash
+	if b, _ := br.Peek(1); b[0]&0x80 != 0 {
+		return openpgp.ReadKeyRing(br)
+	}
+	return openpgp.ReadArmoredKeyRing(br)
+}
+
 type KeyIDSearch []byte
 
 // ParseKeyIDSearch parses a key ID search prefixed with "0x". If the supplied
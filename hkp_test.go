@@ -2,13 +2,43 @@ package hkp_test
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	hkp "github.com/emersion/go-openpgp-hkp"
 )
 
@@ -23,11 +53,13 @@ func init() {
 }
 
 type mockBackend struct {
-	added openpgp.EntityList
+	added     openpgp.EntityList
+	principal *hkp.Principal
 }
 
 func (mb *mockBackend) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
-	if req.Search != "stallman" {
+	fingerprint := hkp.ParseKeyIDSearch(req.Search).Fingerprint()
+	if req.Search != "stallman" && !bytes.Equal(fingerprint, stallmanPubkey[0].PrimaryKey.Fingerprint) {
 		return nil, nil
 	}
 	return stallmanPubkey, nil
@@ -54,6 +86,144 @@ func (mb *mockBackend) Add(keys openpgp.EntityList) error {
 	return nil
 }
 
+func (mb *mockBackend) AddAuthenticated(p *hkp.Principal, keys openpgp.EntityList) error {
+	mb.principal = p
+	return mb.Add(keys)
+}
+
+// keyringBackend is a backend serving keys from a key ring, by fingerprint or
+// by identity.
+type keyringBackend struct {
+	el      openpgp.EntityList
+	hidden  map[string]bool
+	removed map[string][]string
+}
+
+func (kb *keyringBackend) search(req *hkp.LookupRequest) openpgp.EntityList {
+	fingerprint := hkp.ParseKeyIDSearch(req.Search).Fingerprint()
+	var el openpgp.EntityList
+	for _, e := range kb.el {
+		if kb.hidden[string(e.PrimaryKey.Fingerprint)] {
+			continue
+		}
+		if bytes.Equal(e.PrimaryKey.Fingerprint, fingerprint) {
+			el = append(el, e)
+			continue
+		}
+		for name := range e.Identities {
+			if fingerprint == nil && strings.Contains(name, req.Search) {
+				el = append(el, e)
+				break
+			}
+		}
+	}
+	return el
+}
+
+func (kb *keyringBackend) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
+	el := kb.search(req)
+	if len(el) == 0 {
+		return nil, hkp.ErrNotFound
+	}
+	return el, nil
+}
+
+func (kb *keyringBackend) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
+	var keys []hkp.IndexKey
+	for _, e := range kb.search(req) {
+		key, err := hkp.IndexKeyFromEntity(e)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	if len(keys) == 0 {
+		return nil, hkp.ErrNotFound
+	}
+	return keys, nil
+}
+
+func (kb *keyringBackend) Add(el openpgp.EntityList) error {
+	kb.el = append(kb.el, el...)
+	return nil
+}
+
+func (kb *keyringBackend) Key(fingerprint []byte) (*openpgp.Entity, error) {
+	for _, e := range kb.el {
+		if bytes.Equal(e.PrimaryKey.Fingerprint, fingerprint) {
+			return e, nil
+		}
+	}
+	return nil, hkp.ErrNotFound
+}
+
+func (kb *keyringBackend) DeleteKey(fingerprint []byte) error {
+	for i, e := range kb.el {
+		if bytes.Equal(e.PrimaryKey.Fingerprint, fingerprint) {
+			kb.el = append(kb.el[:i], kb.el[i+1:]...)
+			return nil
+		}
+	}
+	return hkp.ErrNotFound
+}
+
+func (kb *keyringBackend) UnhideKey(fingerprint []byte) error {
+	delete(kb.hidden, string(fingerprint))
+	return nil
+}
+
+func (kb *keyringBackend) RemoveIdentity(fingerprint []byte, name string) error {
+	if kb.removed == nil {
+		kb.removed = make(map[string][]string)
+	}
+	kb.removed[string(fingerprint)] = append(kb.removed[string(fingerprint)], name)
+	return nil
+}
+
+func (kb *keyringBackend) RemovedIdentities(fingerprint []byte) ([]string, error) {
+	return kb.removed[string(fingerprint)], nil
+}
+
+// staticLookuper is a Lookuper returning the same keys for any request.
+type staticLookuper openpgp.EntityList
+
+func (sl staticLookuper) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
+	return openpgp.EntityList(sl), nil
+}
+
+func (sl staticLookuper) Index(req *hkp.LookupRequest) ([]hkp.IndexKey, error) {
+	return nil, hkp.ErrNotFound
+}
+
+// failingAdder is an Adder which always fails.
+type failingAdder struct{}
+
+func (failingAdder) Add(el openpgp.EntityList) error {
+	return errors.New("storage failure")
+}
+
+func newTestEntity(t *testing.T, email string) *openpgp.Entity {
+	config := packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	e, err := openpgp.NewEntity("", "", email, &config)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity(): %v", err)
+	}
+	return e
+}
+
+// copyEntity returns a copy of the public part of an entity.
+func copyEntity(t *testing.T, e *openpgp.Entity) *openpgp.Entity {
+	var b bytes.Buffer
+	if err := e.Serialize(&b); err != nil {
+		t.Fatalf("Entity.Serialize(): %v", err)
+	}
+	el, err := openpgp.ReadKeyRing(&b)
+	if err != nil {
+		t.Fatalf("openpgp.ReadKeyRing(): %v", err)
+	}
+	return el[0]
+}
+
 func Test_index(t *testing.T) {
 	h := hkp.Handler{Lookuper: &mockBackend{}}
 	ts := httptest.NewServer(&h)
@@ -81,6 +251,16 @@ func Test_index(t *testing.T) {
 				Flags:        0,
 			},
 		},
+		Subkeys: []hkp.IndexSubkey{
+			{
+				CreationTime: creationTime.Local(),
+				Algo:         1,
+				Fingerprint:  stallmanPubkey[0].Subkeys[0].PublicKey.Fingerprint,
+				BitLength:    4096,
+				Flags:        0,
+				Usage:        hkp.IndexUsageEncrypt,
+			},
+		},
 	}
 
 	if len(index) != 1 {
@@ -90,6 +270,60 @@ func Test_index(t *testing.T) {
 	}
 }
 
+func Test_indexJSON(t *testing.T) {
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+
+	want, err := c.Index(&hkp.LookupRequest{Search: "stallman"})
+	if err != nil {
+		t.Fatalf("Client.Index(): %v", err)
+	}
+
+	req := hkp.LookupRequest{
+		Search:  "stallman",
+		Options: hkp.LookupOptions{JSON: true},
+	}
+	got, err := c.Index(&req)
+	if err != nil {
+		t.Fatalf("Client.Index() with JSON: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Client.Index with JSON: got %+v, want %+v", got, want)
+	}
+}
+
+func Test_indexNotFound(t *testing.T) {
+	var requests int
+	h := hkp.Handler{Lookuper: &keyringBackend{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c := hkp.Client{
+		Host:             ts.URL,
+		Insecure:         true,
+		Cache:            hkp.NewLRUCache(16),
+		NegativeCacheTTL: time.Hour,
+	}
+
+	for i := 0; i < 2; i++ {
+		req := hkp.LookupRequest{Search: "nobody@example.org"}
+		if _, err := c.Index(&req); err != hkp.ErrNotFound {
+			t.Errorf("Client.Index() = %v, want %v", err, hkp.ErrNotFound)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("got %v requests, want 1", requests)
+	}
+}
+
 func Test_get(t *testing.T) {
 	h := hkp.Handler{Lookuper: &mockBackend{}}
 	ts := httptest.NewServer(&h)
@@ -110,20 +344,1906 @@ func Test_get(t *testing.T) {
 	}
 }
 
-func Test_add(t *testing.T) {
-	mb := mockBackend{}
-	h := hkp.Handler{Adder: &mb}
+func Test_getKeyserverURI(t *testing.T) {
+	h := hkp.Handler{Lookuper: &mockBackend{}}
 	ts := httptest.NewServer(&h)
 	defer ts.Close()
 
-	c := hkp.Client{Host: ts.URL, Insecure: true}
+	uri := "hkp://" + ts.Listener.Addr().String()
+	c, err := hkp.ParseKeyserverURI(uri)
+	if err != nil {
+		t.Fatalf("ParseKeyserverURI(): %v", err)
+	}
 
-	if err := c.Add(stallmanPubkey); err != nil {
-		t.Fatalf("Client.Add(): %v", err)
+	req := hkp.LookupRequest{Search: "stallman"}
+	if _, err := c.Get(&req); err != nil {
+		t.Errorf("Client.Get() with %q: %v", uri, err)
 	}
 
-	if len(mb.added) != 1 {
-		t.Errorf("want 1 key added, got %v", len(mb.added))
+	c.Insecure = false
+	if _, err := c.Get(&req); err == nil {
+		t.Errorf("Client.Get() with %q and Insecure unset: want error", uri)
+	}
+}
+
+func TestParseKeyserverURI(t *testing.T) {
+	testCases := []struct {
+		uri      string
+		host     string
+		insecure bool
+	}{
+		{"hkps://keys.openpgp.org", "hkps://keys.openpgp.org", false},
+		{"hkp://pgp.mit.edu:11371", "hkp://pgp.mit.edu:11371", true},
+		{"https://keyserver.ubuntu.com", "https://keyserver.ubuntu.com", false},
+		{"http://localhost:8080", "http://localhost:8080", true},
+		{"keys.openpgp.org", "hkps://keys.openpgp.org", false},
+	}
+	for _, tc := range testCases {
+		c, err := hkp.ParseKeyserverURI(tc.uri)
+		if err != nil {
+			t.Errorf("ParseKeyserverURI(%q): %v", tc.uri, err)
+		} else if c.Host != tc.host || c.Insecure != tc.insecure {
+			t.Errorf("ParseKeyserverURI(%q) = {Host: %q, Insecure: %v}, want {Host: %q, Insecure: %v}", tc.uri, c.Host, c.Insecure, tc.host, tc.insecure)
+		}
+	}
+
+	for _, uri := range []string{"ldap://keys.example.org", "hkps://"} {
+		if _, err := hkp.ParseKeyserverURI(uri); err == nil {
+			t.Errorf("ParseKeyserverURI(%q): want error", uri)
+		}
+	}
+}
+
+func TestReadGnuPGConfig(t *testing.T) {
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+	ts := httptest.NewTLSServer(&h)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	caFilename := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFilename, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyserver := "hkps://" + ts.Listener.Addr().String()
+	files := map[string]string{
+		"gpg.conf": "keyserver hkps://keys.example.org\nkeyserver-options honor-http-proxy\n",
+		"dirmngr.conf": "# Comment\n" +
+			"keyserver " + keyserver + "\n" +
+			"hkp-cacert " + caFilename + "\n" +
+			"no-use-tor\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := hkp.ReadGnuPGConfig(dir)
+	if err != nil {
+		t.Fatalf("ReadGnuPGConfig(): %v", err)
+	}
+	want := hkp.GnuPGConfig{
+		Keyservers:     []string{keyserver},
+		CACertFiles:    []string{caFilename},
+		HonorHTTPProxy: true,
+	}
+	if !reflect.DeepEqual(cfg, &want) {
+		t.Errorf("ReadGnuPGConfig() = %#v, want %#v", cfg, &want)
+	}
+
+	clients, err := cfg.Clients()
+	if err != nil {
+		t.Fatalf("GnuPGConfig.Clients(): %v", err)
+	} else if len(clients) != 1 {
+		t.Fatalf("GnuPGConfig.Clients(): got %v clients, want 1", len(clients))
+	}
+	if _, err := clients[0].Get(&hkp.LookupRequest{Search: "stallman"}); err != nil {
+		t.Errorf("Client.Get(): %v", err)
+	}
+
+	cfg, err = hkp.ReadGnuPGConfig(t.TempDir())
+	if err != nil {
+		t.Fatalf("ReadGnuPGConfig() with empty directory: %v", err)
+	} else if len(cfg.Keyservers) != 1 || cfg.Keyservers[0] != "hkps://keys.openpgp.org" {
+		t.Errorf("ReadGnuPGConfig() with empty directory: got keyservers %v, want default", cfg.Keyservers)
+	}
+}
+
+func TestClient_tls(t *testing.T) {
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+	ts := httptest.NewTLSServer(&h)
+	defer ts.Close()
+
+	caFilename := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFilename, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	spki := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+
+	req := hkp.LookupRequest{Search: "stallman"}
+
+	c := hkp.Client{Host: ts.URL}
+	if _, err := c.Get(&req); err == nil {
+		t.Errorf("Client.Get() without CA file: expected an error")
+	}
+
+	c = hkp.Client{Host: ts.URL, CAFile: caFilename, PinnedSPKI: []string{pin}}
+	if _, err := c.Get(&req); err != nil {
+		t.Errorf("Client.Get() with CA file and matching pin: %v", err)
+	}
+
+	c = hkp.Client{Host: ts.URL, TLSConfig: &tls.Config{InsecureSkipVerify: true}, PinnedSPKI: []string{pin}}
+	if _, err := c.Get(&req); err != nil {
+		t.Errorf("Client.Get() with matching pin only: %v", err)
+	}
+
+	c = hkp.Client{Host: ts.URL, CAFile: caFilename, PinnedSPKI: []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}
+	_, err := c.Get(&req)
+	var pinErr *hkp.PinError
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("Client.Get() with mismatching pin: got %v, want a PinError", err)
+	}
+	if len(pinErr.SPKI) != 1 || pinErr.SPKI[0] != pin {
+		t.Errorf("PinError.SPKI = %v, want [%v]", pinErr.SPKI, pin)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	c = hkp.Client{Host: ts.URL, HTTPClient: &http.Client{Transport: transport}, PinnedSPKI: []string{pin}}
+	if _, err := c.Get(&req); err != nil {
+		t.Errorf("Client.Get() with transport root CAs and matching pin: %v", err)
+	}
+}
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(): %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(): %v", err)
+	}
+	return der, priv
+}
+
+func TestClient_tlsPinUnverified(t *testing.T) {
+	leaf, priv := newTestCertificate(t)
+	pinned, _ := newTestCertificate(t)
+
+	// The server appends the pinned certificate to its chain, but it isn't
+	// part of the verified chain
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+	ts := httptest.NewUnstartedServer(&h)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leaf, pinned}, PrivateKey: priv}},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	leafCert, err := x509.ParseCertificate(leaf)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(): %v", err)
+	}
+	pinnedCert, err := x509.ParseCertificate(pinned)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(): %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leafCert)
+	spki := sha256.Sum256(pinnedCert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+
+	req := hkp.LookupRequest{Search: "stallman"}
+	var pinErr *hkp.PinError
+
+	c := hkp.Client{Host: ts.URL, TLSConfig: &tls.Config{RootCAs: pool}, PinnedSPKI: []string{pin}}
+	if _, err := c.Get(&req); !errors.As(err, &pinErr) {
+		t.Errorf("Client.Get() with pin outside of the verified chain: got %v, want a PinError", err)
+	}
+
+	c = hkp.Client{Host: ts.URL, TLSConfig: &tls.Config{InsecureSkipVerify: true}, PinnedSPKI: []string{pin}}
+	if _, err := c.Get(&req); !errors.As(err, &pinErr) {
+		t.Errorf("Client.Get() with pin on an intermediate certificate and InsecureSkipVerify: got %v, want a PinError", err)
+	}
+}
+
+// socksServer is a minimal SOCKS5 proxy which connects all requests to a
+// fixed address, recording the requested destinations and usernames.
+type socksServer struct {
+	target string
+
+	mutex     sync.Mutex
+	dests     []string
+	usernames []string
+}
+
+func (srv *socksServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handle(conn)
+	}
+}
+
+func (srv *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var buf [256]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	method := buf[0]
+	conn.Write([]byte{0x05, method})
+
+	var username string
+	if method == 0x02 {
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+		username = string(buf[:buf[1]])
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[0]]); err != nil {
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil || buf[3] != 0x03 {
+		return
+	}
+	n := int(buf[4])
+	if _, err := io.ReadFull(conn, buf[:n+2]); err != nil {
+		return
+	}
+	dest := net.JoinHostPort(string(buf[:n]), strconv.Itoa(int(buf[n])<<8|int(buf[n+1])))
+
+	srv.mutex.Lock()
+	srv.dests = append(srv.dests, dest)
+	srv.usernames = append(srv.usernames, username)
+	srv.mutex.Unlock()
+
+	upstream, err := net.Dial("tcp", srv.target)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestClient_socks(t *testing.T) {
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := socksServer{target: ts.Listener.Addr().String()}
+	go srv.serve(ln)
+
+	c := hkp.Client{
+		Host:           "hkp://keyserver.onion",
+		Insecure:       true,
+		SOCKSProxy:     ln.Addr().String(),
+		IsolateStreams: true,
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(&hkp.LookupRequest{Search: "stallman"}); err != nil {
+			t.Fatalf("Client.Get(): %v", err)
+		}
+	}
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if len(srv.dests) != 2 {
+		t.Fatalf("got %v SOCKS connections, want 2", len(srv.dests))
+	}
+	for _, dest := range srv.dests {
+		if dest != "keyserver.onion:11371" {
+			t.Errorf("SOCKS destination = %q, want %q", dest, "keyserver.onion:11371")
+		}
+	}
+	if srv.usernames[0] == "" || srv.usernames[0] == srv.usernames[1] {
+		t.Errorf("SOCKS usernames = %q, want unique credentials per request", srv.usernames)
+	}
+}
+
+func TestOpenPGPKeyName(t *testing.T) {
+	// Example from RFC 7929 section 3
+	name, err := hkp.OpenPGPKeyName("hugh@example.com")
+	if err != nil {
+		t.Fatalf("OpenPGPKeyName(): %v", err)
+	}
+	want := "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com"
+	if name != want {
+		t.Errorf("OpenPGPKeyName() = %q, want %q", name, want)
+	}
+
+	if _, err := hkp.OpenPGPKeyName("invalid"); err == nil {
+		t.Errorf("OpenPGPKeyName() with invalid address: expected an error")
+	}
+}
+
+// dnsResponse builds a response to a DNS query with a single answer. If
+// rdata is nil, the response is truncated.
+func dnsResponse(query, rdata []byte) []byte {
+	// Strip the OPT record from the query
+	qlen := bytes.IndexByte(query[12:], 0) + 12 + 5
+	resp := append([]byte(nil), query[:qlen]...)
+	resp[2], resp[3] = 0x81, 0x80 // QR, RD, RA
+	resp[10], resp[11] = 0, 0     // ARCOUNT
+	if rdata == nil {
+		resp[2] |= 0x02 // TC
+		return resp
+	}
+	resp[7] = 1 // ANCOUNT
+	resp = append(resp, 0xC0, 12, 0, 61, 0, 1, 0, 0, 0x0E, 0x10, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(resp, rdata...)
+}
+
+func TestDANEClient(t *testing.T) {
+	var b bytes.Buffer
+	if err := stallmanPubkey[0].Serialize(&b); err != nil {
+		t.Fatal(err)
+	}
+	rdata := b.Bytes()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	owner, _ := hkp.OpenPGPKeyName("rms@gnu.org")
+	var wantQName []byte
+	for _, label := range strings.Split(owner, ".") {
+		wantQName = append(wantQName, byte(len(label)))
+		wantQName = append(wantQName, label...)
+	}
+
+	// Force a retry over TCP by truncating UDP responses
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsResponse(buf[:n], nil), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var lenBuf [2]byte
+			if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+				conn.Close()
+				continue
+			}
+			query := make([]byte, int(lenBuf[0])<<8|int(lenBuf[1]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				conn.Close()
+				continue
+			}
+			var resp []byte
+			if bytes.Contains(query, wantQName) {
+				resp = dnsResponse(query, rdata)
+			} else {
+				resp = dnsResponse(query, []byte{})
+				resp[3] |= 3 // NXDOMAIN
+				resp[7] = 0
+				resp = resp[:len(resp)-12]
+			}
+			conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			conn.Close()
+		}
+	}()
+
+	c := hkp.DANEClient{Server: ln.Addr().String()}
+	el, err := c.Get("rms@gnu.org")
+	if err != nil {
+		t.Fatalf("DANEClient.Get(): %v", err)
+	}
+	if len(el) != 1 || !bytes.Equal(el[0].PrimaryKey.Fingerprint, stallmanPubkey[0].PrimaryKey.Fingerprint) {
+		t.Errorf("DANEClient.Get(): got %v keys, want stallman's key", len(el))
+	}
+
+	if _, err := c.Get("nobody@gnu.org"); err != hkp.ErrNotFound {
+		t.Errorf("DANEClient.Get() with unknown address: got %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	c.RequireAuthenticated = true
+	if _, err := c.Get("rms@gnu.org"); err == nil {
+		t.Errorf("DANEClient.Get() with RequireAuthenticated: expected an error")
+	}
+}
+
+// fakeDNSConn is a connection to a DNS server which replies to queries with a
+// fixed response, with the ID of the query.
+type fakeDNSConn struct {
+	net.Conn
+	tcp  bool
+	resp []byte
+	buf  []byte
+}
+
+func (conn *fakeDNSConn) Write(b []byte) (int, error) {
+	query := b
+	if conn.tcp {
+		query = b[2:]
+	}
+	resp := append([]byte(nil), conn.resp...)
+	if len(resp) >= 2 {
+		copy(resp, query[:2])
+	}
+	if conn.tcp {
+		resp = append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)
+	}
+	conn.buf = resp
+	return len(b), nil
+}
+
+func (conn *fakeDNSConn) Read(b []byte) (int, error) {
+	if len(conn.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, conn.buf)
+	conn.buf = conn.buf[n:]
+	return n, nil
+}
+
+func (conn *fakeDNSConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *fakeDNSConn) Close() error {
+	return nil
+}
+
+// dnsQuery builds a query for the OPENPGPKEY records of a name, with an OPT
+// record.
+func dnsQuery(name string) []byte {
+	query := []byte{0, 0, 0x01, 0x20, 0, 1, 0, 0, 0, 0, 0, 1}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 61, 0, 1)
+	return append(query, 0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func newFakeDANEClient(resp []byte) *hkp.DANEClient {
+	return &hkp.DANEClient{
+		Server: "192.0.2.1:53",
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return &fakeDNSConn{tcp: network == "tcp", resp: resp}, nil
+		},
+	}
+}
+
+func TestDANEClient_mismatch(t *testing.T) {
+	var b bytes.Buffer
+	if err := stallmanPubkey[0].Serialize(&b); err != nil {
+		t.Fatal(err)
+	}
+	rdata := b.Bytes()
+	owner, _ := hkp.OpenPGPKeyName("rms@gnu.org")
+
+	if _, err := newFakeDANEClient(dnsResponse(dnsQuery(owner), rdata)).Get("rms@gnu.org"); err != nil {
+		t.Fatalf("DANEClient.Get(): %v", err)
+	}
+
+	other, _ := hkp.OpenPGPKeyName("mallory@example.org")
+	if _, err := newFakeDANEClient(dnsResponse(dnsQuery(other), rdata)).Get("rms@gnu.org"); err == nil {
+		t.Errorf("DANEClient.Get() with mismatched question: expected an error")
+	}
+
+	// Answer for another name
+	resp := dnsResponse(dnsQuery(owner), rdata)
+	i := len(dnsQuery(owner)) - 11
+	resp[i], resp[i+1] = 0xC0, 12+1+56 // pointer to "_openpgpkey.gnu.org"
+	if _, err := newFakeDANEClient(resp).Get("rms@gnu.org"); err != hkp.ErrNotFound {
+		t.Errorf("DANEClient.Get() with answer for another name: got %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	// Answer with another class
+	resp = dnsResponse(dnsQuery(owner), rdata)
+	resp[i+5] = 3 // CH
+	if _, err := newFakeDANEClient(resp).Get("rms@gnu.org"); err != hkp.ErrNotFound {
+		t.Errorf("DANEClient.Get() with answer in another class: got %v, want %v", err, hkp.ErrNotFound)
+	}
+}
+
+func FuzzDANEClient(f *testing.F) {
+	var b bytes.Buffer
+	if err := stallmanPubkey[0].Serialize(&b); err != nil {
+		f.Fatal(err)
+	}
+	owner, _ := hkp.OpenPGPKeyName("rms@gnu.org")
+	query := dnsQuery(owner)
+	f.Add(dnsResponse(query, b.Bytes()))
+	f.Add(dnsResponse(query, []byte{0x99, 0x00}))
+	f.Add(dnsResponse(query, nil))
+
+	f.Fuzz(func(t *testing.T, resp []byte) {
+		el, err := newFakeDANEClient(resp).Get("rms@gnu.org")
+		if err == nil && len(el) == 0 {
+			t.Errorf("DANEClient.Get() returned no keys and no error")
+		}
+	})
+}
+
+func TestWriteOpenPGPKeyRecords(t *testing.T) {
+	var b bytes.Buffer
+	if err := hkp.WriteOpenPGPKeyRecords(&b, stallmanPubkey, "gnu.org"); err != nil {
+		t.Fatalf("WriteOpenPGPKeyRecords(): %v", err)
+	}
+
+	owner, _ := hkp.OpenPGPKeyName("rms@gnu.org")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("WriteOpenPGPKeyRecords(): got %v lines, want 2", len(lines))
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) != 4 || fields[0] != owner+"." || fields[1] != "IN" || fields[2] != "OPENPGPKEY" {
+		t.Fatalf("WriteOpenPGPKeyRecords(): invalid record %q", lines[1])
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		t.Fatalf("failed to decode record data: %v", err)
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read key from record: %v", err)
+	}
+	if len(el) != 1 || len(el[0].Identities) != 1 {
+		t.Errorf("WriteOpenPGPKeyRecords(): record should contain a single key with a single identity")
+	}
+
+	b.Reset()
+	if err := hkp.WriteOpenPGPKeyRecords(&b, stallmanPubkey, "example.org"); err != nil {
+		t.Fatalf("WriteOpenPGPKeyRecords(): %v", err)
+	} else if b.Len() != 0 {
+		t.Errorf("WriteOpenPGPKeyRecords() for another domain = %q, want no records", b.String())
+	}
+
+	if err := hkp.WriteOpenPGPKeyRecords(&b, stallmanPubkey, "gnu.org\n@"); err == nil {
+		t.Errorf("WriteOpenPGPKeyRecords() with invalid domain: want error")
+	}
+}
+
+func TestWriteOpenPGPKeyRecords_injection(t *testing.T) {
+	config := packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	e, err := openpgp.NewEntity("Mallory\nexample.org. IN A 192.0.2.1\n;", "", "mallory@example.org", &config)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity(): %v", err)
+	}
+	if err := e.AddUserId("", "", "mallory@example.org\nexample.org. IN A 192.0.2.1", &config); err != nil {
+		t.Fatalf("Entity.AddUserId(): %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := hkp.WriteOpenPGPKeyRecords(&b, openpgp.EntityList{e}, "example.org"); err != nil {
+		t.Fatalf("WriteOpenPGPKeyRecords(): %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("WriteOpenPGPKeyRecords() = %q, want a single record", b.String())
+	}
+	if !strings.HasPrefix(lines[0], "; ") || !strings.Contains(lines[1], " IN OPENPGPKEY ") {
+		t.Errorf("WriteOpenPGPKeyRecords() = %q, want a comment and a single record", b.String())
+	}
+}
+
+func TestWKDURLs(t *testing.T) {
+	// Example from draft-koch-openpgp-webkey-service
+	advanced, direct, err := hkp.WKDURLs("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatalf("WKDURLs(): %v", err)
+	}
+	wantAdvanced := "https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe"
+	wantDirect := "https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe"
+	if advanced != wantAdvanced {
+		t.Errorf("WKDURLs() advanced = %q, want %q", advanced, wantAdvanced)
+	}
+	if direct != wantDirect {
+		t.Errorf("WKDURLs() direct = %q, want %q", direct, wantDirect)
+	}
+}
+
+type keySourceFunc func(ctx context.Context, email string) (openpgp.EntityList, error)
+
+func (f keySourceFunc) LocateKey(ctx context.Context, email string) (openpgp.EntityList, error) {
+	return f(ctx, email)
+}
+
+func TestLocator(t *testing.T) {
+	_, direct, _ := hkp.WKDURLs("rms@gnu.org")
+	directURL, _ := url.Parse(direct)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != directURL.Path {
+			http.NotFound(w, r)
+			return
+		}
+		stallmanPubkey[0].Serialize(w)
+	}))
+	defer ts.Close()
+
+	// Send all requests to the test server, and make the advanced method
+	// fail to exercise the fallback to the direct method
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "openpgpkey.") {
+			host, _, _ := net.SplitHostPort(addr)
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+	wkd := hkp.WKDClient{HTTPClient: &http.Client{Transport: transport}}
+
+	failing := keySourceFunc(func(ctx context.Context, email string) (openpgp.EntityList, error) {
+		return nil, errors.New("network error")
+	})
+	mismatching := keySourceFunc(func(ctx context.Context, email string) (openpgp.EntityList, error) {
+		return stallmanPubkey, nil
+	})
+	slow := keySourceFunc(func(ctx context.Context, email string) (openpgp.EntityList, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	l := hkp.Locator{Sources: []hkp.LocatorSource{
+		{Name: "slow", Source: slow, Timeout: 10 * time.Millisecond},
+		{Name: "failing", Source: failing},
+		{Name: "wkd", Source: &wkd},
+	}}
+	el, err := l.Locate("RMS@gnu.org")
+	if err != nil {
+		t.Fatalf("Locator.Locate(): %v", err)
+	}
+	if len(el) != 1 || !bytes.Equal(el[0].PrimaryKey.Fingerprint, stallmanPubkey[0].PrimaryKey.Fingerprint) {
+		t.Errorf("Locator.Locate(): got %v keys, want stallman's key", len(el))
+	}
+
+	_, err = l.Locate("nobody@gnu.org")
+	var sourceErr *hkp.SourceError
+	if !errors.As(err, &sourceErr) || sourceErr.Name != "slow" {
+		t.Errorf("Locator.Locate() with unknown address: got %v, want a source error", err)
+	}
+
+	l = hkp.Locator{Sources: []hkp.LocatorSource{
+		{Name: "mismatching", Source: mismatching},
+		{Name: "local", Source: hkp.KeyRing(stallmanPubkey)},
+	}}
+	if _, err := l.Locate("nobody@gnu.org"); err != hkp.ErrNotFound {
+		t.Errorf("Locator.Locate() with mismatching key: got %v, want %v", err, hkp.ErrNotFound)
+	}
+	if _, err := l.Locate("rms@gnu.org"); err != nil {
+		t.Errorf("Locator.Locate() with local keyring: %v", err)
+	}
+
+	// Other errors of the advanced method don't fall back to the direct one
+	transport = transport.Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "openpgpkey.") {
+			return nil, errors.New("connection refused")
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+	wkd = hkp.WKDClient{HTTPClient: &http.Client{Transport: transport}}
+	if _, err := wkd.Get("rms@gnu.org"); err == nil {
+		t.Errorf("WKDClient.Get() with unreachable advanced method: expected an error")
+	}
+}
+
+func TestLocator_revoked(t *testing.T) {
+	revoked := newTestEntity(t, "alice@example.org")
+	if err := revoked.RevokeKey(packet.KeyRetired, "", nil); err != nil {
+		t.Fatalf("Entity.RevokeKey(): %v", err)
+	}
+
+	config := packet.Config{
+		Algorithm:       packet.PubKeyAlgoEdDSA,
+		KeyLifetimeSecs: 60,
+		Time:            func() time.Time { return time.Now().Add(-time.Hour) },
+	}
+	expired, err := openpgp.NewEntity("", "", "alice@example.org", &config)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity(): %v", err)
+	}
+
+	l := hkp.Locator{Sources: []hkp.LocatorSource{
+		{Name: "local", Source: hkp.KeyRing{revoked, expired}},
+	}}
+	if _, err := l.Locate("alice@example.org"); err != hkp.ErrNotFound {
+		t.Errorf("Locator.Locate() with revoked and expired keys: got %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	valid := newTestEntity(t, "alice@example.org")
+	l.Sources[0].Source = hkp.KeyRing{revoked, expired, valid}
+	el, err := l.Locate("alice@example.org")
+	if err != nil {
+		t.Fatalf("Locator.Locate(): %v", err)
+	} else if len(el) != 1 || el[0] != valid {
+		t.Errorf("Locator.Locate(): got %v keys, want the valid one", len(el))
+	}
+}
+
+func Test_getBinary(t *testing.T) {
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+
+	req := hkp.LookupRequest{
+		Search:  "stallman",
+		Options: hkp.LookupOptions{Binary: true},
+	}
+	keys, err := c.Get(&req)
+	if err != nil {
+		t.Fatalf("Client.Get(): %v", err)
+	}
+
+	if len(keys) != 1 {
+		t.Errorf("Client.Get: got %v key, want 1", len(keys))
+	} else if !bytes.Equal(keys[0].PrimaryKey.Fingerprint[:], stallmanPubkey[0].PrimaryKey.Fingerprint[:]) {
+		t.Errorf("Client.Get: got %+v, want %+v", keys[0], stallmanPubkey[0])
+	}
+
+	for _, tc := range []struct {
+		query, accept string
+		binary        bool
+	}{
+		{"", "", false},
+		{"", "application/pgp-keys", false},
+		{"", "application/pgp-keys; encoding=binary", true},
+		{"&options=binary", "", true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/pks/lookup?op=get&search=stallman"+tc.query, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil || mediaType != "application/pgp-keys" {
+			t.Errorf("Content-Type with query %q and Accept %q = %q, want application/pgp-keys", tc.query, tc.accept, w.Header().Get("Content-Type"))
+		} else if binary := params["encoding"] == "binary"; binary != tc.binary {
+			t.Errorf("Content-Type with query %q and Accept %q = %q, want binary = %v", tc.query, tc.accept, w.Header().Get("Content-Type"), tc.binary)
+		}
+		if binary := w.Body.Len() > 0 && w.Body.Bytes()[0]&0x80 != 0; binary != tc.binary {
+			t.Errorf("body with query %q and Accept %q: got binary = %v, want %v", tc.query, tc.accept, binary, tc.binary)
+		}
+	}
+}
+
+func Test_getMany(t *testing.T) {
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+
+	fingerprints := [][]byte{
+		stallmanPubkey[0].PrimaryKey.Fingerprint,
+		stallmanPubkey[0].Subkeys[0].PublicKey.Fingerprint,
+	}
+
+	for _, batch := range []bool{true, false} {
+		var handler http.Handler = &h
+		if !batch {
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet {
+					http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				h.ServeHTTP(w, r)
+			})
+		}
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+
+		c := hkp.Client{Host: ts.URL, Insecure: true}
+
+		keys, err := c.GetMany(fingerprints)
+		if err != nil {
+			t.Fatalf("Client.GetMany() with batch = %v: %v", batch, err)
+		}
+
+		if len(keys) != 1 {
+			t.Errorf("Client.GetMany with batch = %v: got %v keys, want 1", batch, len(keys))
+		}
+	}
+}
+
+// notFoundBackend is a mockBackend which wraps ErrNotFound when a key can't
+// be found.
+type notFoundBackend struct {
+	mockBackend
+}
+
+func (nb *notFoundBackend) Get(req *hkp.LookupRequest) (openpgp.EntityList, error) {
+	el, err := nb.mockBackend.Get(req)
+	if err == nil && len(el) == 0 {
+		err = fmt.Errorf("backend: %w", hkp.ErrNotFound)
+	}
+	return el, err
+}
+
+func Test_getMany_wrappedNotFound(t *testing.T) {
+	ts := httptest.NewServer(&hkp.Handler{Lookuper: &notFoundBackend{}})
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+	keys, err := c.GetMany([][]byte{
+		stallmanPubkey[0].PrimaryKey.Fingerprint,
+		stallmanPubkey[0].Subkeys[0].PublicKey.Fingerprint,
+	})
+	if err != nil {
+		t.Fatalf("Client.GetMany(): %v", err)
+	} else if len(keys) != 1 {
+		t.Errorf("Client.GetMany(): got %v keys, want 1", len(keys))
+	}
+}
+
+func Test_getCache(t *testing.T) {
+	for _, maxAge := range []time.Duration{time.Hour, 0} {
+		var requests, conditionalRequests int
+		h := hkp.Handler{Lookuper: &mockBackend{}, CacheMaxAge: maxAge}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("If-None-Match") != "" {
+				conditionalRequests++
+			}
+			h.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+
+		c := hkp.Client{Host: ts.URL, Insecure: true, Cache: hkp.NewLRUCache(16)}
+
+		for i := 0; i < 2; i++ {
+			req := hkp.LookupRequest{Search: "stallman"}
+			keys, err := c.Get(&req)
+			if err != nil {
+				t.Fatalf("Client.Get(): %v", err)
+			} else if len(keys) != 1 {
+				t.Errorf("Client.Get: got %v keys, want 1", len(keys))
+			}
+		}
+
+		wantRequests, wantConditionalRequests := 1, 0
+		if maxAge == 0 {
+			wantRequests, wantConditionalRequests = 2, 1
+		}
+		if requests != wantRequests || conditionalRequests != wantConditionalRequests {
+			t.Errorf("with max-age %v: got %v requests (%v conditional), want %v (%v conditional)",
+				maxAge, requests, conditionalRequests, wantRequests, wantConditionalRequests)
+		}
+	}
+}
+
+func Test_getRetry(t *testing.T) {
+	var requests int
+	h := hkp.Handler{Lookuper: &mockBackend{}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+	req := hkp.LookupRequest{Search: "stallman"}
+	if _, err := c.Get(&req); err != hkp.ErrUnavailable {
+		t.Errorf("Client.Get() without retry = %v, want %v", err, hkp.ErrUnavailable)
+	}
+
+	requests = 0
+	c.Retry = &hkp.RetryPolicy{MaxAttempts: 3}
+	if _, err := c.Get(&req); err != nil {
+		t.Errorf("Client.Get() with retry = %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("got %v requests, want 2", requests)
+	}
+}
+
+func TestHandler_rateLimit(t *testing.T) {
+	h := hkp.Handler{
+		Lookuper: &mockBackend{},
+		RateLimiter: &hkp.RateLimiter{
+			Lookup:         hkp.Rate{Burst: 2, Interval: time.Hour},
+			TrustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+	}
+
+	lookup := func(remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/pks/lookup?op=get&search=stallman", nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := lookup("198.51.100.1:1234", ""); w.Code != http.StatusOK {
+			t.Fatalf("request #%v: got status %v, want %v", i, w.Code, http.StatusOK)
+		}
+	}
+	w := lookup("198.51.100.1:1234", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusTooManyRequests)
+	} else if w.Header().Get("Retry-After") == "" {
+		t.Errorf("missing Retry-After")
+	}
+
+	// Requests forwarded by a trusted proxy are limited per client
+	if w := lookup("192.0.2.1:1234", "198.51.100.2"); w.Code != http.StatusOK {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusOK)
+	}
+	if w := lookup("192.0.2.1:1234", "198.51.100.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+	// Untrusted clients can't spoof their address
+	if w := lookup("198.51.100.1:1234", "198.51.100.3"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func Test_add(t *testing.T) {
+	mb := mockBackend{}
+	h := hkp.Handler{Adder: &mb}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+
+	if err := c.Add(stallmanPubkey); err != nil {
+		t.Fatalf("Client.Add(): %v", err)
+	}
+
+	if len(mb.added) != 1 {
+		t.Errorf("want 1 key added, got %v", len(mb.added))
+	}
+}
+
+func Test_addBinary(t *testing.T) {
+	mb := mockBackend{}
+	h := hkp.Handler{Adder: &mb}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true, BinaryUpload: true}
+
+	if err := c.Add(stallmanPubkey); err != nil {
+		t.Fatalf("Client.Add(): %v", err)
+	}
+
+	if len(mb.added) != 1 {
+		t.Errorf("want 1 key added, got %v", len(mb.added))
+	}
+}
+
+func Test_addTooLarge(t *testing.T) {
+	mb := mockBackend{}
+	h := hkp.Handler{Adder: &mb}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("keytext", "key.pgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(make([]byte, 33<<20))
+	mw.Close()
+
+	resp, err := http.Post(ts.URL+"/pks/add", mw.FormDataContentType(), &b)
+	if err != nil {
+		t.Fatalf("http.Post(): %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	body := "keytext=" + strings.Repeat("A", 33<<20)
+	resp, err = http.Post(ts.URL+"/pks/add", "application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.Post(): %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	if len(mb.added) != 0 {
+		t.Errorf("want no key added, got %v", len(mb.added))
+	}
+}
+
+func Test_addAuthenticated(t *testing.T) {
+	mb := mockBackend{}
+	h := hkp.Handler{
+		Adder:         &mb,
+		Authenticator: hkp.TokenAuthenticator{"s3cr3t": "alice"},
+	}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+	if err := c.Add(stallmanPubkey); err != hkp.ErrUnauthorized {
+		t.Errorf("Client.Add() without token = %v, want %v", err, hkp.ErrUnauthorized)
+	}
+
+	c.BearerToken = "s3cr3t"
+	if err := c.Add(stallmanPubkey); err != nil {
+		t.Fatalf("Client.Add(): %v", err)
+	}
+	if mb.principal == nil || mb.principal.Name != "alice" {
+		t.Errorf("got principal %+v, want alice", mb.principal)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	var (
+		kb     keyringBackend
+		mailer hkp.MemoryMailer
+	)
+	v := hkp.Verifier{
+		Lookuper: &kb,
+		Adder:    &kb,
+		Mailer:   &mailer,
+		Key:      []byte("s3cr3t"),
+	}
+	h := hkp.Handler{Lookuper: &v, Adder: &v, Verifier: &v}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+	v.BaseURL = ts.URL
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+
+	e := newTestEntity(t, "alice@example.org")
+	if err := c.Add(openpgp.EntityList{e}); err != nil {
+		t.Fatalf("Client.Add(): %v", err)
+	}
+
+	req := hkp.LookupRequest{Search: "alice@example.org"}
+	if _, err := c.Index(&req); err != hkp.ErrNotFound {
+		t.Errorf("Client.Index() before verification = %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("got %v verification mails, want 1", len(sent))
+	} else if sent[0].Email != "alice@example.org" {
+		t.Errorf("got verification mail for %q, want %q", sent[0].Email, "alice@example.org")
+	}
+
+	// Keys are still listed without identities for key ID searches
+	fprReq := hkp.LookupRequest{Search: "0x" + hex.EncodeToString(e.PrimaryKey.Fingerprint)}
+	if keys, err := c.Index(&fprReq); err != nil {
+		t.Errorf("Client.Index() by fingerprint before verification: %v", err)
+	} else if len(keys) != 1 || len(keys[0].Identities) != 0 {
+		t.Errorf("Client.Index() by fingerprint before verification: got %v keys, want 1 without identities", len(keys))
+	}
+	if _, err := c.Get(&fprReq); err != hkp.ErrNotFound {
+		t.Errorf("Client.Get() by fingerprint before verification = %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	// Visiting the verification URL only shows a form
+	resp, err := http.Get(sent[0].URL)
+	if err != nil {
+		t.Fatalf("http.Get(): %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("verification form: got status %v, want %v", resp.StatusCode, http.StatusOK)
+	} else if !strings.Contains(string(body), "<form") {
+		t.Errorf("verification form: missing form in body:\n%s", body)
+	}
+	if _, err := c.Index(&req); err != hkp.ErrNotFound {
+		t.Errorf("Client.Index() after visiting verification URL = %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	resp, err = http.PostForm(ts.URL+"/pks/verify", url.Values{"token": {sent[0].Token}})
+	if err != nil {
+		t.Fatalf("http.PostForm(): %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("verification: got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	keys, err := c.Get(&req)
+	if err != nil {
+		t.Fatalf("Client.Get() after verification: %v", err)
+	} else if len(keys) != 1 || len(keys[0].Identities) != 1 {
+		t.Errorf("Client.Get: got %v keys, want 1 with 1 identity", len(keys))
+	}
+
+	resp, err = http.Get(ts.URL + "/pks/verify?token=" + sent[0].Token[1:])
+	if err != nil {
+		t.Fatalf("http.Get(): %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("verification form with invalid token: got status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.PostForm(ts.URL+"/pks/verify", url.Values{"token": {sent[0].Token[1:]}})
+	if err != nil {
+		t.Fatalf("http.PostForm(): %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("verification with invalid token: got status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestVerifier_throttle(t *testing.T) {
+	var (
+		kb     keyringBackend
+		mailer hkp.MemoryMailer
+	)
+	v := hkp.Verifier{
+		Lookuper: &kb,
+		Adder:    &kb,
+		Mailer:   &mailer,
+		Key:      []byte("s3cr3t"),
+	}
+
+	e := newTestEntity(t, "alice@example.org")
+	other := newTestEntity(t, "Alice@example.org")
+	for _, el := range []openpgp.EntityList{{e}, {e}, {other}} {
+		if err := v.Add(el); err != nil {
+			t.Fatalf("Verifier.Add(): %v", err)
+		}
+	}
+
+	if sent := mailer.Sent(); len(sent) != 1 {
+		t.Errorf("got %v verification mails, want 1", len(sent))
+	}
+}
+
+func TestHandler_manage(t *testing.T) {
+	e := newTestEntity(t, "")
+	other := newTestEntity(t, "")
+	kb := keyringBackend{
+		el:     openpgp.EntityList{copyEntity(t, e), copyEntity(t, other)},
+		hidden: map[string]bool{string(e.PrimaryKey.Fingerprint): true},
+	}
+	h := hkp.Handler{Lookuper: &kb, KeyManager: &kb}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+	req := hkp.LookupRequest{Search: "0x" + hex.EncodeToString(e.PrimaryKey.Fingerprint)}
+
+	if err := c.UnhideKey(e); err != nil {
+		t.Fatalf("Client.UnhideKey(): %v", err)
+	}
+	if _, err := c.Get(&req); err != nil {
+		t.Errorf("Client.Get() after unhiding: %v", err)
+	}
+
+	// Sign the challenge with another key
+	forged := *other
+	forged.PrimaryKey = e.PrimaryKey
+	if err := c.DeleteKey(&forged); err != hkp.ErrForbidden {
+		t.Errorf("Client.DeleteKey() with forged signature = %v, want %v", err, hkp.ErrForbidden)
+	}
+
+	if err := c.DeleteKey(e); err != nil {
+		t.Fatalf("Client.DeleteKey(): %v", err)
+	}
+	if _, err := c.Get(&req); err != hkp.ErrNotFound {
+		t.Errorf("Client.Get() after deletion = %v, want %v", err, hkp.ErrNotFound)
+	}
+	if err := c.DeleteKey(e); err != hkp.ErrNotFound {
+		t.Errorf("Client.DeleteKey() after deletion = %v, want %v", err, hkp.ErrNotFound)
+	}
+}
+
+func TestHandler_challengeLimit(t *testing.T) {
+	e := newTestEntity(t, "")
+	kb := keyringBackend{el: openpgp.EntityList{copyEntity(t, e)}}
+	h := hkp.Handler{Lookuper: &kb, KeyManager: &kb}
+
+	form := url.Values{
+		"op":     {"delete"},
+		"search": {"0x" + hex.EncodeToString(e.PrimaryKey.Fingerprint)},
+	}.Encode()
+	for i := 0; ; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/pks/challenge", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code == http.StatusOK {
+			if i > 100000 {
+				t.Fatalf("got more than %v pending challenges", i)
+			}
+			continue
+		}
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("challenge #%v: got status %v, want %v", i, w.Code, http.StatusServiceUnavailable)
+		}
+		break
+	}
+}
+
+func TestHandler_removeIdentity(t *testing.T) {
+	e := newTestEntity(t, "alice@example.org")
+	if err := e.AddUserId("", "", "alice@example.com", nil); err != nil {
+		t.Fatalf("Entity.AddUserId(): %v", err)
+	}
+	kb := keyringBackend{el: openpgp.EntityList{copyEntity(t, e)}}
+	h := hkp.Handler{Lookuper: &kb, KeyManager: &kb}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+
+	if err := c.RemoveIdentity(e, "<alice@example.com>"); err != nil {
+		t.Fatalf("Client.RemoveIdentity(): %v", err)
+	}
+	if err := c.RemoveIdentity(e, "<bob@example.org>"); err != hkp.ErrNotFound {
+		t.Errorf("Client.RemoveIdentity() with unknown identity = %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	if _, err := c.Index(&hkp.LookupRequest{Search: "alice@example.com"}); err != hkp.ErrNotFound {
+		t.Errorf("Client.Index() for removed identity = %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	keys, err := c.Index(&hkp.LookupRequest{Search: "alice@example.org"})
+	if err != nil {
+		t.Fatalf("Client.Index(): %v", err)
+	} else if len(keys) != 1 || len(keys[0].Identities) != 1 || keys[0].Identities[0].Name != "<alice@example.org>" {
+		t.Errorf("Client.Index() = %#v, want a single key with identity %q", keys, "<alice@example.org>")
+	}
+
+	exactReq := hkp.LookupRequest{Search: "alice@example.org", Exact: true}
+	if keys, err := c.Index(&exactReq); err != nil {
+		t.Errorf("Client.Index() with exact email search: %v", err)
+	} else if len(keys) != 1 {
+		t.Errorf("Client.Index() with exact email search: got %v keys, want 1", len(keys))
+	}
+	if el, err := c.Get(&exactReq); err != nil {
+		t.Errorf("Client.Get() with exact email search: %v", err)
+	} else if len(el) != 1 {
+		t.Errorf("Client.Get() with exact email search: got %v keys, want 1", len(el))
+	}
+
+	req := hkp.LookupRequest{Search: "0x" + hex.EncodeToString(e.PrimaryKey.Fingerprint)}
+	el, err := c.Get(&req)
+	if err != nil {
+		t.Fatalf("Client.Get(): %v", err)
+	} else if len(el) != 1 || len(el[0].Identities) != 1 || el[0].Identities["<alice@example.org>"] == nil {
+		t.Errorf("Client.Get() returned unexpected identities")
+	} else if len(el[0].Subkeys) != len(e.Subkeys) {
+		t.Errorf("Client.Get() returned %v subkeys, want %v", len(el[0].Subkeys), len(e.Subkeys))
+	}
+}
+
+func TestHandler_removeIdentityReplay(t *testing.T) {
+	e := newTestEntity(t, "alice@example.org")
+	if err := e.AddUserId("", "", "alice@example.com", nil); err != nil {
+		t.Fatalf("Entity.AddUserId(): %v", err)
+	}
+	kb := keyringBackend{el: openpgp.EntityList{copyEntity(t, e)}}
+	h := hkp.Handler{Lookuper: &kb, KeyManager: &kb}
+	ts := httptest.NewServer(&h)
+	defer ts.Close()
+
+	search := "0x" + hex.EncodeToString(e.PrimaryKey.Fingerprint)
+	resp, err := http.PostForm(ts.URL+"/pks/challenge", url.Values{
+		"op":     {"remove-uid"},
+		"search": {search},
+		"uid":    {"<alice@example.com>"},
+	})
+	if err != nil {
+		t.Fatalf("http.PostForm(): %v", err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read challenge: %v", err)
+	} else if resp.StatusCode != http.StatusOK {
+		t.Fatalf("challenge: got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	challenge := string(b)
+
+	var sig strings.Builder
+	if err := openpgp.ArmoredDetachSign(&sig, e, strings.NewReader(challenge), nil); err != nil {
+		t.Fatalf("openpgp.ArmoredDetachSign(): %v", err)
+	}
+
+	// The challenge has been issued for another identity
+	resp, err = http.PostForm(ts.URL+"/pks/manage", url.Values{
+		"op":        {"remove-uid"},
+		"search":    {search},
+		"uid":       {"<alice@example.org>"},
+		"challenge": {challenge},
+		"signature": {sig.String()},
+	})
+	if err != nil {
+		t.Fatalf("http.PostForm(): %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("removing another identity: got status %v, want %v", resp.StatusCode, http.StatusForbidden)
+	}
+	if removed, _ := kb.RemovedIdentities(e.PrimaryKey.Fingerprint); len(removed) != 0 {
+		t.Errorf("removed identities = %v, want none", removed)
+	}
+}
+
+func TestProxyLookuper(t *testing.T) {
+	alice := newTestEntity(t, "alice@example.org")
+	bob := newTestEntity(t, "bob@example.org")
+	upstream1 := keyringBackend{el: openpgp.EntityList{copyEntity(t, alice)}}
+	if err := alice.AddUserId("", "", "alice@work.example.org", nil); err != nil {
+		t.Fatalf("Entity.AddUserId(): %v", err)
+	}
+	upstream2 := keyringBackend{el: openpgp.EntityList{copyEntity(t, alice), copyEntity(t, bob)}}
+
+	var upstreams []*hkp.Client
+	for _, kb := range []*keyringBackend{&upstream1, &upstream2} {
+		ts := httptest.NewServer(&hkp.Handler{Lookuper: kb})
+		defer ts.Close()
+		upstreams = append(upstreams, &hkp.Client{Host: ts.URL, Insecure: true})
+	}
+	// An unreachable upstream shouldn't prevent lookups
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	upstreams = append(upstreams, &hkp.Client{Host: down.URL, Insecure: true})
+
+	var local keyringBackend
+	pl := hkp.ProxyLookuper{
+		Local:        &local,
+		Upstreams:    upstreams,
+		WriteThrough: &local,
+	}
+
+	req := hkp.LookupRequest{Search: "example.org"}
+	keys, err := pl.Index(&req)
+	if err != nil {
+		t.Fatalf("ProxyLookuper.Index(): %v", err)
+	} else if len(keys) != 2 {
+		t.Fatalf("ProxyLookuper.Index(): got %v keys, want 2", len(keys))
+	} else if len(keys[0].Identities) != 2 {
+		t.Errorf("ProxyLookuper.Index(): got %v identities, want 2", len(keys[0].Identities))
+	}
+
+	el, err := pl.Get(&req)
+	if err != nil {
+		t.Fatalf("ProxyLookuper.Get(): %v", err)
+	} else if len(el) != 2 {
+		t.Fatalf("ProxyLookuper.Get(): got %v keys, want 2", len(el))
+	} else if len(el[0].Identities) != 2 {
+		t.Errorf("ProxyLookuper.Get(): got %v identities, want 2", len(el[0].Identities))
+	}
+	if len(local.el) != 2 {
+		t.Errorf("got %v keys written through, want 2", len(local.el))
+	}
+
+	if _, err := pl.Get(&hkp.LookupRequest{Search: "carol"}); err != hkp.ErrNotFound {
+		t.Errorf("ProxyLookuper.Get() for unknown key = %v, want %v", err, hkp.ErrNotFound)
+	}
+}
+
+func TestProxyLookuper_untrusted(t *testing.T) {
+	alice := newTestEntity(t, "alice@example.org")
+	mallory := newTestEntity(t, "mallory@example.org")
+	ts := httptest.NewServer(&hkp.Handler{Lookuper: staticLookuper{copyEntity(t, alice), copyEntity(t, mallory)}})
+	defer ts.Close()
+
+	var local keyringBackend
+	pl := hkp.ProxyLookuper{
+		Upstreams:    []*hkp.Client{{Host: ts.URL, Insecure: true}},
+		WriteThrough: &local,
+	}
+
+	for _, search := range []string{"0x" + hex.EncodeToString(alice.PrimaryKey.Fingerprint), "alice@example.org"} {
+		local.el = nil
+		el, err := pl.Get(&hkp.LookupRequest{Search: search})
+		if err != nil {
+			t.Fatalf("ProxyLookuper.Get(%q): %v", search, err)
+		} else if len(el) != 1 || !bytes.Equal(el[0].PrimaryKey.Fingerprint, alice.PrimaryKey.Fingerprint) {
+			t.Errorf("ProxyLookuper.Get(%q): got %v keys, want alice's key", search, len(el))
+		}
+		if len(local.el) != 1 {
+			t.Errorf("ProxyLookuper.Get(%q): got %v keys written through, want 1", search, len(local.el))
+		}
+	}
+
+	if _, err := pl.Get(&hkp.LookupRequest{Search: "carol"}); err != hkp.ErrNotFound {
+		t.Errorf("ProxyLookuper.Get() for unknown key = %v, want %v", err, hkp.ErrNotFound)
+	}
+
+	var writeErr error
+	pl.WriteThrough = failingAdder{}
+	pl.WriteThroughFailed = func(err error) {
+		writeErr = err
+	}
+	if _, err := pl.Get(&hkp.LookupRequest{Search: "alice@example.org"}); err != nil {
+		t.Errorf("ProxyLookuper.Get() with failing write-through: %v", err)
+	}
+	if writeErr == nil {
+		t.Errorf("ProxyLookuper.WriteThroughFailed wasn't called")
+	}
+}
+
+func TestMultiAdder(t *testing.T) {
+	var (
+		backends [3]mockBackend
+		targets  []*hkp.Client
+		failures atomic.Int32
+	)
+	failures.Store(1)
+	for i := range backends {
+		h := &hkp.Handler{Adder: &backends[i]}
+		var handler http.Handler = h
+		if i == 2 {
+			// Fail the first upload
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failures.Add(-1) >= 0 {
+					http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				h.ServeHTTP(w, r)
+			})
+		}
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+		targets = append(targets, &hkp.Client{Host: ts.URL, Insecure: true})
+	}
+
+	var retryFailed []*hkp.TargetError
+	ma := hkp.MultiAdder{
+		Targets: targets,
+		Quorum:  2,
+		Retry:   &hkp.RetryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond},
+		RetryFailed: func(err *hkp.TargetError) {
+			retryFailed = append(retryFailed, err)
+		},
+	}
+	defer ma.Close()
+
+	if err := ma.Add(stallmanPubkey); err != nil {
+		t.Fatalf("MultiAdder.Add(): %v", err)
+	}
+	ma.Wait()
+	for i, mb := range backends {
+		if len(mb.added) != 1 {
+			t.Errorf("target #%v: got %v keys, want 1", i, len(mb.added))
+		}
+	}
+	if len(retryFailed) > 0 {
+		t.Errorf("RetryFailed called: %v", retryFailed[0])
+	}
+
+	failures.Store(2)
+	ma.Quorum = 0
+	err := ma.Add(stallmanPubkey)
+	var multiErr *hkp.MultiAddError
+	if !errors.As(err, &multiErr) {
+		t.Fatalf("MultiAdder.Add() = %v, want a MultiAddError", err)
+	} else if len(multiErr.Errors) != 1 || multiErr.Errors[0].Target != targets[2] || multiErr.Succeeded != 2 {
+		t.Errorf("MultiAdder.Add() = %v, want a single failure for target #2", err)
+	} else if !errors.Is(err, hkp.ErrUnavailable) {
+		t.Errorf("MultiAdder.Add() = %v, want %v", err, hkp.ErrUnavailable)
+	}
+	ma.Wait()
+	if len(retryFailed) != 1 || retryFailed[0].Target != targets[2] {
+		t.Errorf("RetryFailed: got %v calls, want 1 for target #2", len(retryFailed))
+	}
+}
+
+func TestMultiAdder_close(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	var retryFailed atomic.Int32
+	ma := hkp.MultiAdder{
+		Targets: []*hkp.Client{{Host: ts.URL, Insecure: true}},
+		Retry:   &hkp.RetryPolicy{MaxAttempts: 2, MinBackoff: time.Hour},
+		RetryFailed: func(err *hkp.TargetError) {
+			retryFailed.Add(1)
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ma.Add(stallmanPubkey)
+		}()
+		go func() {
+			defer wg.Done()
+			ma.Wait()
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ma.Close()
+	}()
+	wg.Wait()
+
+	// Retries must not be started after Close
+	n := retryFailed.Load()
+	if err := ma.Add(stallmanPubkey); err == nil {
+		t.Errorf("MultiAdder.Add() with a failing target: expected an error")
+	}
+	ma.Wait()
+	if retryFailed.Load() != n {
+		t.Errorf("RetryFailed called after Close")
+	}
+}
+
+func TestWriteVerificationMessage(t *testing.T) {
+	e := newTestEntity(t, "alice@example.org")
+	v := hkp.Verification{
+		Email:   "alice@example.org",
+		Entity:  copyEntity(t, e),
+		URL:     "https://keys.example.org/pks/verify?token=s3cr3t",
+		Expires: time.Now().Add(time.Hour),
+	}
+
+	var b bytes.Buffer
+	if err := hkp.WriteVerificationMessage(&b, "keyserver@example.org", &v); err != nil {
+		t.Fatalf("WriteVerificationMessage(): %v", err)
+	}
+
+	msg, err := mail.ReadMessage(&b)
+	if err != nil {
+		t.Fatalf("mail.ReadMessage(): %v", err)
+	}
+	if to, err := msg.Header.AddressList("To"); err != nil || len(to) != 1 || to[0].Address != v.Email {
+		t.Errorf("To = %q, want %q", msg.Header.Get("To"), v.Email)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/encrypted" {
+		t.Fatalf("Content-Type = %q, want multipart/encrypted", msg.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatalf("NextPart(): %v", err)
+	}
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("NextPart(): %v", err)
+	}
+
+	block, err := armor.Decode(p)
+	if err != nil {
+		t.Fatalf("armor.Decode(): %v", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{e}, nil, nil)
+	if err != nil {
+		t.Fatalf("openpgp.ReadMessage(): %v", err)
+	}
+	plaintext, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("failed to decrypt message: %v", err)
+	}
+	if !strings.Contains(string(plaintext), v.URL) {
+		t.Errorf("decrypted message doesn't contain verification URL:\n%s", plaintext)
+	}
+}
+
+func TestWriteVerificationMessage_injection(t *testing.T) {
+	e := newTestEntity(t, "alice@example.org")
+	v := hkp.Verification{
+		Email:   "alice@example.org\r\nBcc: mallory@example.org",
+		Entity:  copyEntity(t, e),
+		URL:     "https://keys.example.org/pks/verify?token=s3cr3t",
+		Expires: time.Now().Add(time.Hour),
+	}
+
+	var b bytes.Buffer
+	if err := hkp.WriteVerificationMessage(&b, "keyserver@example.org", &v); err == nil {
+		t.Errorf("WriteVerificationMessage() with CRLF in recipient: expected an error")
+	}
+
+	v.Email = "alice@example.org"
+	if err := hkp.WriteVerificationMessage(&b, "keyserver@example.org\nBcc: mallory@example.org", &v); err == nil {
+		t.Errorf("WriteVerificationMessage() with LF in sender: expected an error")
+	}
+}
+
+func TestIndexKeyFromEntity_ecc(t *testing.T) {
+	e := newTestEntity(t, "alice@example.org")
+
+	key, err := hkp.IndexKeyFromEntity(e)
+	if err != nil {
+		t.Fatalf("IndexKeyFromEntity(): %v", err)
+	}
+
+	if s := key.AlgoString(); s != "ed25519" {
+		t.Errorf("key.AlgoString() = %q, want %q", s, "ed25519")
+	}
+	if oid := key.CurveOID(); oid != "1.3.6.1.4.1.11591.15.1" {
+		t.Errorf("key.CurveOID() = %q, want %q", oid, "1.3.6.1.4.1.11591.15.1")
+	}
+	if key.BitLength != 255 {
+		t.Errorf("key.BitLength = %v, want 255", key.BitLength)
+	}
+	if len(key.Subkeys) != 1 {
+		t.Fatalf("len(key.Subkeys) = %v, want 1", len(key.Subkeys))
+	} else if s := key.Subkeys[0].AlgoString(); s != "cv25519" {
+		t.Errorf("subkey.AlgoString() = %q, want %q", s, "cv25519")
+	}
+}
+
+func TestIndexKeyFromEntity_nistp256(t *testing.T) {
+	config := packet.Config{Algorithm: packet.PubKeyAlgoECDSA, Curve: packet.CurveNistP256}
+	e, err := openpgp.NewEntity("", "", "alice@example.org", &config)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity(): %v", err)
+	}
+
+	key, err := hkp.IndexKeyFromEntity(e)
+	if err != nil {
+		t.Fatalf("IndexKeyFromEntity(): %v", err)
+	}
+	if key.Curve != "nistp256" || key.BitLength != 256 {
+		t.Errorf("key.Curve = %q, key.BitLength = %v, want nistp256 and 256", key.Curve, key.BitLength)
+	}
+	if oid := key.CurveOID(); oid != "1.2.840.10045.3.1.7" {
+		t.Errorf("key.CurveOID() = %q, want %q", oid, "1.2.840.10045.3.1.7")
+	}
+	if len(key.Subkeys) != 1 {
+		t.Fatalf("len(key.Subkeys) = %v, want 1", len(key.Subkeys))
+	} else if key.Subkeys[0].Curve != "nistp256" {
+		t.Errorf("subkey.Curve = %q, want nistp256", key.Subkeys[0].Curve)
+	}
+}
+
+func TestIndexKeyFromEntity_noExpiration(t *testing.T) {
+	// Keys generated by go-crypto have a zero key lifetime, which means that
+	// they don't expire
+	e := newTestEntity(t, "alice@example.org")
+	if lifetime := e.PrimaryIdentity().SelfSignature.KeyLifetimeSecs; lifetime == nil || *lifetime != 0 {
+		t.Fatalf("expected a zero key lifetime")
+	}
+
+	key, err := hkp.IndexKeyFromEntity(e)
+	if err != nil {
+		t.Fatalf("IndexKeyFromEntity(): %v", err)
+	}
+	if !key.ExpirationTime.IsZero() {
+		t.Errorf("key.ExpirationTime = %v, want zero", key.ExpirationTime)
+	}
+	if len(key.Subkeys) != 1 {
+		t.Fatalf("len(key.Subkeys) = %v, want 1", len(key.Subkeys))
+	} else if !key.Subkeys[0].ExpirationTime.IsZero() {
+		t.Errorf("subkey.ExpirationTime = %v, want zero", key.Subkeys[0].ExpirationTime)
+	}
+}
+
+func TestIndexKeyFromEntity_expiration(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	config := packet.Config{
+		Algorithm:       packet.PubKeyAlgoEdDSA,
+		KeyLifetimeSecs: 365 * 24 * 60 * 60,
+		Time:            func() time.Time { return created },
+	}
+	e, err := openpgp.NewEntity("", "", "alice@example.org", &config)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity(): %v", err)
+	}
+	want := created.Add(365 * 24 * time.Hour)
+
+	// Re-issue the self-signature and the subkey binding signature one month
+	// later, with the same lifetime as the primary key
+	config.Time = func() time.Time { return created.AddDate(0, 1, 0) }
+	ident := e.PrimaryIdentity()
+	ident.SelfSignature.CreationTime = config.Now()
+	if err := ident.SelfSignature.SignUserId(ident.UserId.Id, e.PrimaryKey, e.PrivateKey, &config); err != nil {
+		t.Fatalf("Signature.SignUserId(): %v", err)
+	}
+	sk := &e.Subkeys[0]
+	sk.Sig.CreationTime = config.Now()
+	sk.Sig.KeyLifetimeSecs = ident.SelfSignature.KeyLifetimeSecs
+	if err := sk.Sig.SignKey(sk.PublicKey, e.PrivateKey, &config); err != nil {
+		t.Fatalf("Signature.SignKey(): %v", err)
+	}
+
+	key, err := hkp.IndexKeyFromEntity(e)
+	if err != nil {
+		t.Fatalf("IndexKeyFromEntity(): %v", err)
+	}
+	if !key.ExpirationTime.Equal(want) {
+		t.Errorf("key.ExpirationTime = %v, want %v", key.ExpirationTime, want)
+	}
+	if key.Flags != hkp.IndexKeyExpired {
+		t.Errorf("key.Flags = %v, want %v", key.Flags, hkp.IndexKeyExpired)
+	}
+	if len(key.Subkeys) != 1 {
+		t.Fatalf("len(key.Subkeys) = %v, want 1", len(key.Subkeys))
+	} else if !key.Subkeys[0].ExpirationTime.Equal(want) {
+		t.Errorf("subkey.ExpirationTime = %v, want %v", key.Subkeys[0].ExpirationTime, want)
+	}
+}
+
+func TestIndexKeyFromEntity_revoked(t *testing.T) {
+	e := newTestEntity(t, "alice@example.org")
+	if err := e.RevokeKey(packet.KeyCompromised, "", nil); err != nil {
+		t.Fatalf("Entity.RevokeKey(): %v", err)
+	}
+
+	key, err := hkp.IndexKeyFromEntity(e)
+	if err != nil {
+		t.Fatalf("IndexKeyFromEntity(): %v", err)
+	}
+	if key.Flags != hkp.IndexKeyRevoked {
+		t.Errorf("key.Flags = %v, want %v", key.Flags, hkp.IndexKeyRevoked)
+	}
+}
+
+// revokedIdentityEntity returns the public part of an entity with an
+// additional user ID which only has a certification revocation. If
+// withIdentity is false, the entity has no other user ID.
+func revokedIdentityEntity(t *testing.T, e *openpgp.Entity, withIdentity bool) *openpgp.Entity {
+	var b bytes.Buffer
+	if withIdentity {
+		if err := e.Serialize(&b); err != nil {
+			t.Fatalf("Entity.Serialize(): %v", err)
+		}
+	} else if err := e.PrimaryKey.Serialize(&b); err != nil {
+		t.Fatalf("PublicKey.Serialize(): %v", err)
+	}
+
+	uid := packet.NewUserId("", "", "mallory@example.org")
+	sig := packet.Signature{
+		Version:      e.PrimaryKey.Version,
+		SigType:      packet.SigTypeCertificationRevocation,
+		PubKeyAlgo:   e.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &e.PrimaryKey.KeyId,
+	}
+	if err := sig.SignUserId(uid.Id, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+		t.Fatalf("Signature.SignUserId(): %v", err)
+	}
+	if err := uid.Serialize(&b); err != nil {
+		t.Fatalf("UserId.Serialize(): %v", err)
+	}
+	if err := sig.Serialize(&b); err != nil {
+		t.Fatalf("Signature.Serialize(): %v", err)
+	}
+
+	revoked, err := openpgp.ReadEntity(packet.NewReader(&b))
+	if err != nil {
+		t.Fatalf("openpgp.ReadEntity(): %v", err)
+	}
+	if ident := revoked.Identities[uid.Id]; ident == nil || ident.SelfSignature != nil {
+		t.Fatalf("openpgp.ReadEntity(): want an identity without self-signature")
+	}
+	return revoked
+}
+
+func TestIndexKeyFromEntity_revokedIdentity(t *testing.T) {
+	e := newTestEntity(t, "alice@example.org")
+
+	for _, withIdentity := range []bool{true, false} {
+		revoked := revokedIdentityEntity(t, e, withIdentity)
+
+		key, err := hkp.IndexKeyFromEntity(revoked)
+		if err != nil {
+			t.Fatalf("IndexKeyFromEntity(): %v", err)
+		}
+		want := 0
+		if withIdentity {
+			want = 1
+		}
+		if len(key.Identities) != want {
+			t.Errorf("IndexKeyFromEntity(): got %v identities, want %v", len(key.Identities), want)
+		}
+
+		dst := copyEntity(t, e)
+		hkp.MergeEntity(dst, revoked)
+		hkp.MergeEntity(revoked, copyEntity(t, e))
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	remote := newTestEntity(t, "alice@example.org")
+	local := copyEntity(t, remote)
+	unchanged := copyEntity(t, newTestEntity(t, "bob@example.org"))
+	missing := newTestEntity(t, "carol@example.org")
+
+	if err := remote.AddSigningSubkey(nil); err != nil {
+		t.Fatalf("Entity.AddSigningSubkey(): %v", err)
+	}
+	if err := remote.RevokeKey(packet.KeySuperseded, "", nil); err != nil {
+		t.Fatalf("Entity.RevokeKey(): %v", err)
+	}
+
+	kb := keyringBackend{el: openpgp.EntityList{remote, unchanged}}
+	ts := httptest.NewServer(&hkp.Handler{Lookuper: &kb})
+	defer ts.Close()
+
+	c := hkp.Client{Host: ts.URL, Insecure: true}
+
+	el := openpgp.EntityList{local, unchanged, missing}
+	results, err := hkp.Refresh(context.Background(), &c, el, nil)
+	if err != nil {
+		t.Fatalf("Refresh(): %v", err)
+	}
+
+	wantChanges := hkp.RefreshNewRevocation | hkp.RefreshNewSubkey
+	if res := results[0]; res.Err != nil || res.Changes != wantChanges {
+		t.Errorf("Refresh: got changes %v (%v), want %v", res.Changes, res.Err, wantChanges)
+	}
+	if !local.Revoked(time.Now()) {
+		t.Errorf("Refresh: key not revoked")
+	}
+	if len(local.Subkeys) != 2 {
+		t.Errorf("Refresh: got %v subkeys, want 2", len(local.Subkeys))
+	}
+	if res := results[1]; res.Err != nil || res.Changes != 0 {
+		t.Errorf("Refresh: got changes %v (%v), want none", res.Changes, res.Err)
+	}
+	if res := results[2]; res.Err != hkp.ErrNotFound {
+		t.Errorf("Refresh: got error %v, want %v", res.Err, hkp.ErrNotFound)
 	}
 }
 
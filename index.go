@@ -15,10 +15,15 @@ import (
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
 )
 
+// primarySelfSignature returns the self-signature of the primary identity. It
+// returns nil if no identity has a self-signature, e.g. if all of them only
+// have revocations.
 func primarySelfSignature(e *openpgp.Entity) *packet.Signature {
 	var selfSig *packet.Signature
 	for _, ident := range e.Identities {
-		if selfSig == nil {
+		if ident.SelfSignature == nil {
+			continue
+		} else if selfSig == nil {
 			selfSig = ident.SelfSignature
 		} else if ident.SelfSignature.IsPrimaryId != nil && *ident.SelfSignature.IsPrimaryId {
 			return ident.SelfSignature
@@ -27,12 +32,17 @@ func primarySelfSignature(e *openpgp.Entity) *packet.Signature {
 	return selfSig
 }
 
-func signatureExpirationTime(sig *packet.Signature) time.Time {
-	if sig.KeyLifetimeSecs == nil {
+// keyExpirationTime returns the expiration time of a key from the key
+// lifetime of its self-signature. The lifetime is counted from the key
+// creation time, not the signature creation time (RFC 4880 section
+// 5.2.3.6). If sig is nil, the zero time is returned.
+func keyExpirationTime(key *packet.PublicKey, sig *packet.Signature) time.Time {
+	// A zero lifetime means that the key doesn't expire
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
 		return time.Time{}
 	}
 	dur := time.Duration(*sig.KeyLifetimeSecs) * time.Second
-	return sig.CreationTime.Add(dur)
+	return key.CreationTime.Add(dur)
 }
 
 const indexVersion = 1
@@ -74,14 +84,98 @@ func (flags IndexFlags) format() string {
 	return string(res)
 }
 
+// IndexUsage describes the capabilities of a key.
+type IndexUsage int
+
+const (
+	IndexUsageCertify IndexUsage = 1 << iota
+	IndexUsageSign
+	IndexUsageEncrypt
+	IndexUsageAuthenticate
+)
+
+func parseIndexUsage(s string) (IndexUsage, error) {
+	var res IndexUsage
+	for _, r := range []rune(s) {
+		switch r {
+		case 'c':
+			res |= IndexUsageCertify
+		case 's':
+			res |= IndexUsageSign
+		case 'e':
+			res |= IndexUsageEncrypt
+		case 'a':
+			res |= IndexUsageAuthenticate
+		}
+	}
+	return res, nil
+}
+
+func (usage IndexUsage) format() string {
+	var res []rune
+	if usage&IndexUsageCertify != 0 {
+		res = append(res, 'c')
+	}
+	if usage&IndexUsageSign != 0 {
+		res = append(res, 's')
+	}
+	if usage&IndexUsageEncrypt != 0 {
+		res = append(res, 'e')
+	}
+	if usage&IndexUsageAuthenticate != 0 {
+		res = append(res, 'a')
+	}
+	return string(res)
+}
+
+func signatureUsage(sig *packet.Signature) IndexUsage {
+	if !sig.FlagsValid {
+		return 0
+	}
+	var usage IndexUsage
+	if sig.FlagCertify {
+		usage |= IndexUsageCertify
+	}
+	if sig.FlagSign {
+		usage |= IndexUsageSign
+	}
+	if sig.FlagEncryptCommunications || sig.FlagEncryptStorage {
+		usage |= IndexUsageEncrypt
+	}
+	if sig.FlagAuthenticate {
+		usage |= IndexUsageAuthenticate
+	}
+	return usage
+}
+
 type IndexKey struct {
 	CreationTime   time.Time
 	ExpirationTime time.Time
 	Algo           packet.PublicKeyAlgorithm
 	Fingerprint    []byte
 	BitLength      int
-	Flags          IndexFlags
-	Identities     []IndexIdentity
+	// Curve is the elliptic curve name for ECC keys, e.g. "ed25519". The
+	// machine-readable index format doesn't carry it: it's only set by
+	// IndexKeyFromEntity and when reading a JSON index.
+	Curve      string
+	Flags      IndexFlags
+	Identities []IndexIdentity
+	Subkeys    []IndexSubkey
+}
+
+// AlgoString returns a human-readable description of the key algorithm and
+// size, e.g. "rsa4096" or "ed25519".
+func (key *IndexKey) AlgoString() string {
+	return formatAlgo(key.Algo, key.BitLength, key.Curve)
+}
+
+// CurveOID returns the dotted object identifier of the key's elliptic curve.
+// It returns an empty string for non-ECC keys.
+func (key *IndexKey) CurveOID() string {
+	if curve := curveByName(key.Curve); curve != nil {
+		return curve.oid
+	}
+	return ""
 }
 
 type IndexIdentity struct {
@@ -91,32 +185,134 @@ type IndexIdentity struct {
 	Flags          IndexFlags
 }
 
+// IndexSubkey describes a subkey of an IndexKey.
+type IndexSubkey struct {
+	CreationTime   time.Time
+	ExpirationTime time.Time
+	Algo           packet.PublicKeyAlgorithm
+	Fingerprint    []byte
+	BitLength      int
+	// Curve is the elliptic curve name for ECC keys, e.g. "cv25519". Like
+	// IndexKey.Curve, it's not carried by the machine-readable index format.
+	Curve string
+	Flags IndexFlags
+	Usage IndexUsage
+}
+
+// AlgoString returns a human-readable description of the subkey algorithm
+// and size, e.g. "rsa4096" or "cv25519".
+func (sk *IndexSubkey) AlgoString() string {
+	return formatAlgo(sk.Algo, sk.BitLength, sk.Curve)
+}
+
+// CurveOID returns the dotted object identifier of the subkey's elliptic
+// curve. It returns an empty string for non-ECC keys.
+func (sk *IndexSubkey) CurveOID() string {
+	if curve := curveByName(sk.Curve); curve != nil {
+		return curve.oid
+	}
+	return ""
+}
+
+// publicKeyAlgo returns the bit length and curve name of a public key. For
+// ECC keys, the bit length is the size of the curve rather than the size of
+// the encoded point.
+func publicKeyAlgo(pk *packet.PublicKey) (bitLength int, curveName string, err error) {
+	curve, err := publicKeyCurve(pk)
+	if err != nil {
+		return 0, "", err
+	} else if curve != nil {
+		return curve.bitLength, curve.name, nil
+	}
+
+	bitLen, err := pk.BitLength()
+	if err != nil {
+		return 0, "", err
+	}
+	return int(bitLen), "", nil
+}
+
+func indexSubkeyFromSubkey(sk *openpgp.Subkey, now time.Time) (*IndexSubkey, error) {
+	bitLen, curve, err := publicKeyAlgo(sk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	expirationTime := keyExpirationTime(sk.PublicKey, sk.Sig)
+
+	var flags IndexFlags
+	if sk.Revoked(now) {
+		flags |= IndexKeyRevoked
+	}
+	if !expirationTime.IsZero() && expirationTime.Before(now) {
+		flags |= IndexKeyExpired
+	}
+
+	return &IndexSubkey{
+		CreationTime:   sk.PublicKey.CreationTime,
+		ExpirationTime: expirationTime,
+		Algo:           sk.PublicKey.PubKeyAlgo,
+		Fingerprint:    sk.PublicKey.Fingerprint,
+		BitLength:      bitLen,
+		Curve:          curve,
+		Flags:          flags,
+		Usage:          signatureUsage(sk.Sig),
+	}, nil
+}
+
 // IndexKeyFromEntity creates an IndexKey from an openpgp.Entity.
 func IndexKeyFromEntity(e *openpgp.Entity) (*IndexKey, error) {
 	key := e.PrimaryKey
 	sig := primarySelfSignature(e)
 
-	bitLen, err := key.BitLength()
+	bitLen, curve, err := publicKeyAlgo(key)
 	if err != nil {
 		return nil, err
 	}
 
 	idents := make([]IndexIdentity, 0, len(e.Identities))
 	for _, ident := range e.Identities {
+		// Identities with a revocation but no self-signature
+		if ident.SelfSignature == nil {
+			continue
+		}
 		idents = append(idents, IndexIdentity{
 			Name:           ident.Name,
 			CreationTime:   ident.SelfSignature.CreationTime,
-			ExpirationTime: signatureExpirationTime(ident.SelfSignature),
+			ExpirationTime: keyExpirationTime(key, ident.SelfSignature),
 		})
 	}
 
+	now := time.Now()
+	expirationTime := keyExpirationTime(key, sig)
+
+	var flags IndexFlags
+	if e.Revoked(now) {
+		flags |= IndexKeyRevoked
+	}
+	if !expirationTime.IsZero() && expirationTime.Before(now) {
+		flags |= IndexKeyExpired
+	}
+
+	subkeys := make([]IndexSubkey, 0, len(e.Subkeys))
+	for i := range e.Subkeys {
+		sk, err := indexSubkeyFromSubkey(&e.Subkeys[i], now)
+		if err != nil {
+			return nil, err
+		}
+		subkeys = append(subkeys, *sk)
+	}
+
 	return &IndexKey{
 		CreationTime:   key.CreationTime,
-		ExpirationTime: signatureExpirationTime(sig),
+		ExpirationTime: expirationTime,
 		Algo:           key.PubKeyAlgo,
 		Fingerprint:    key.Fingerprint,
-		BitLength:      int(bitLen),
+		BitLength:      bitLen,
+		Curve:          curve,
+		Flags:          flags,
 		Identities:     idents,
+		Subkeys:        subkeys,
 	}, nil
 }
 
@@ -128,6 +324,11 @@ func formatTime(t time.Time) string {
 }
 
 // writeIndex writes a machine-readable key index to w.
+//
+// Subkeys are written as "sub" records following the identities of their
+// primary key. This is an extension to the format: parsers which don't know
+// about it ignore these records. Elliptic curves aren't written, clients
+// need the JSON format to get them.
 func writeIndex(w io.Writer, keys []IndexKey) error {
 	_, err := fmt.Fprintf(w, "info:%d:%d\n", indexVersion, len(keys))
 	if err != nil {
@@ -152,6 +353,16 @@ func writeIndex(w io.Writer, keys []IndexKey) error {
 				return err
 			}
 		}
+
+		for _, sk := range key.Subkeys {
+			_, err = fmt.Fprintf(w, "sub:%X:%d:%d:%s:%s:%s:%s\n",
+				sk.Fingerprint[:], sk.Algo, sk.BitLength,
+				formatTime(sk.CreationTime), formatTime(sk.ExpirationTime),
+				sk.Flags.format(), sk.Usage.format())
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -270,6 +481,57 @@ func readIndex(r io.Reader) ([]IndexKey, error) {
 				ExpirationTime: expirationTime,
 				Flags:          flags,
 			})
+		case "sub":
+			if len(keys) == 0 {
+				return keys, errors.New("hkp: got sub before pub")
+			}
+			if len(fields) != 8 {
+				return keys, errors.New("hkp: failed to parse sub")
+			}
+
+			fingerprint, err := hex.DecodeString(fields[1])
+			if err != nil {
+				return keys, err
+			}
+			if len(fingerprint) != 20 {
+				return keys, errors.New("hkp: invalid fingerprint size")
+			}
+
+			algo, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return keys, err
+			}
+			bitLen, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return keys, err
+			}
+			creationTime, err := parseTime(fields[4])
+			if err != nil {
+				return keys, err
+			}
+			expirationTime, err := parseTime(fields[5])
+			if err != nil {
+				return keys, err
+			}
+			flags, err := parseIndexFlags(fields[6])
+			if err != nil {
+				return keys, err
+			}
+			usage, err := parseIndexUsage(fields[7])
+			if err != nil {
+				return keys, err
+			}
+
+			lastKey := &keys[len(keys)-1]
+			lastKey.Subkeys = append(lastKey.Subkeys, IndexSubkey{
+				CreationTime:   creationTime,
+				ExpirationTime: expirationTime,
+				Algo:           packet.PublicKeyAlgorithm(algo),
+				Fingerprint:    fingerprint,
+				BitLength:      bitLen,
+				Flags:          flags,
+				Usage:          usage,
+			})
 		}
 	}
 
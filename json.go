@@ -0,0 +1,274 @@
+package hkp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const jsonMediaType = "application/json"
+
+type jsonIndex struct {
+	Version int            `json:"version"`
+	Keys    []jsonIndexKey `json:"keys"`
+}
+
+type jsonIndexKey struct {
+	Fingerprint    string              `json:"fingerprint"`
+	Algo           int                 `json:"algo"`
+	AlgoName       string              `json:"algo_name"`
+	BitLength      int                 `json:"bit_length"`
+	Curve          string              `json:"curve,omitempty"`
+	CurveOID       string              `json:"curve_oid,omitempty"`
+	CreationTime   int64               `json:"creation_time,omitempty"`
+	ExpirationTime int64               `json:"expiration_time,omitempty"`
+	Flags          jsonIndexFlags      `json:"flags"`
+	Identities     []jsonIndexIdentity `json:"identities"`
+	Subkeys        []jsonIndexSubkey   `json:"subkeys"`
+}
+
+type jsonIndexIdentity struct {
+	Name           string         `json:"name"`
+	CreationTime   int64          `json:"creation_time,omitempty"`
+	ExpirationTime int64          `json:"expiration_time,omitempty"`
+	Flags          jsonIndexFlags `json:"flags"`
+}
+
+type jsonIndexSubkey struct {
+	Fingerprint    string         `json:"fingerprint"`
+	Algo           int            `json:"algo"`
+	AlgoName       string         `json:"algo_name"`
+	BitLength      int            `json:"bit_length"`
+	Curve          string         `json:"curve,omitempty"`
+	CurveOID       string         `json:"curve_oid,omitempty"`
+	CreationTime   int64          `json:"creation_time,omitempty"`
+	ExpirationTime int64          `json:"expiration_time,omitempty"`
+	Flags          jsonIndexFlags `json:"flags"`
+	Usage          []string       `json:"usage"`
+}
+
+type jsonIndexFlags struct {
+	Revoked  bool `json:"revoked,omitempty"`
+	Disabled bool `json:"disabled,omitempty"`
+	Expired  bool `json:"expired,omitempty"`
+}
+
+var usageNames = []struct {
+	usage IndexUsage
+	name  string
+}{
+	{IndexUsageCertify, "certify"},
+	{IndexUsageSign, "sign"},
+	{IndexUsageEncrypt, "encrypt"},
+	{IndexUsageAuthenticate, "authenticate"},
+}
+
+func newJSONIndexFlags(flags IndexFlags) jsonIndexFlags {
+	return jsonIndexFlags{
+		Revoked:  flags&IndexKeyRevoked != 0,
+		Disabled: flags&IndexKeyDisabled != 0,
+		Expired:  flags&IndexKeyExpired != 0,
+	}
+}
+
+func (flags jsonIndexFlags) indexFlags() IndexFlags {
+	var res IndexFlags
+	if flags.Revoked {
+		res |= IndexKeyRevoked
+	}
+	if flags.Disabled {
+		res |= IndexKeyDisabled
+	}
+	if flags.Expired {
+		res |= IndexKeyExpired
+	}
+	return res
+}
+
+func formatJSONTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func parseJSONTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func parseJSONFingerprint(s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(fingerprint) != 20 {
+		return nil, errors.New("hkp: invalid fingerprint size")
+	}
+	return fingerprint, nil
+}
+
+// WriteIndexJSON writes a key index to w in the JSON format served by Handler.
+func WriteIndexJSON(w io.Writer, keys []IndexKey) error {
+	index := jsonIndex{
+		Version: indexVersion,
+		Keys:    make([]jsonIndexKey, 0, len(keys)),
+	}
+	for _, key := range keys {
+		k := jsonIndexKey{
+			Fingerprint:    strings.ToUpper(hex.EncodeToString(key.Fingerprint)),
+			Algo:           int(key.Algo),
+			AlgoName:       key.AlgoString(),
+			BitLength:      key.BitLength,
+			Curve:          key.Curve,
+			CurveOID:       key.CurveOID(),
+			CreationTime:   formatJSONTime(key.CreationTime),
+			ExpirationTime: formatJSONTime(key.ExpirationTime),
+			Flags:          newJSONIndexFlags(key.Flags),
+			Identities:     make([]jsonIndexIdentity, 0, len(key.Identities)),
+			Subkeys:        make([]jsonIndexSubkey, 0, len(key.Subkeys)),
+		}
+
+		for _, ident := range key.Identities {
+			k.Identities = append(k.Identities, jsonIndexIdentity{
+				Name:           ident.Name,
+				CreationTime:   formatJSONTime(ident.CreationTime),
+				ExpirationTime: formatJSONTime(ident.ExpirationTime),
+				Flags:          newJSONIndexFlags(ident.Flags),
+			})
+		}
+
+		for _, sk := range key.Subkeys {
+			usage := []string{}
+			for _, u := range usageNames {
+				if sk.Usage&u.usage != 0 {
+					usage = append(usage, u.name)
+				}
+			}
+
+			k.Subkeys = append(k.Subkeys, jsonIndexSubkey{
+				Fingerprint:    strings.ToUpper(hex.EncodeToString(sk.Fingerprint)),
+				Algo:           int(sk.Algo),
+				AlgoName:       sk.AlgoString(),
+				BitLength:      sk.BitLength,
+				Curve:          sk.Curve,
+				CurveOID:       sk.CurveOID(),
+				CreationTime:   formatJSONTime(sk.CreationTime),
+				ExpirationTime: formatJSONTime(sk.ExpirationTime),
+				Flags:          newJSONIndexFlags(sk.Flags),
+				Usage:          usage,
+			})
+		}
+
+		index.Keys = append(index.Keys, k)
+	}
+
+	return json.NewEncoder(w).Encode(&index)
+}
+
+func readIndexJSON(r io.Reader) ([]IndexKey, error) {
+	var index jsonIndex
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, err
+	}
+	if index.Version != indexVersion {
+		return nil, errors.New("hkp: unsupported index version")
+	}
+
+	keys := make([]IndexKey, 0, len(index.Keys))
+	for _, k := range index.Keys {
+		fingerprint, err := parseJSONFingerprint(k.Fingerprint)
+		if err != nil {
+			return keys, err
+		}
+
+		key := IndexKey{
+			CreationTime:   parseJSONTime(k.CreationTime),
+			ExpirationTime: parseJSONTime(k.ExpirationTime),
+			Algo:           packet.PublicKeyAlgorithm(k.Algo),
+			Fingerprint:    fingerprint,
+			BitLength:      k.BitLength,
+			Curve:          k.Curve,
+			Flags:          k.Flags.indexFlags(),
+		}
+
+		for _, ident := range k.Identities {
+			key.Identities = append(key.Identities, IndexIdentity{
+				Name:           ident.Name,
+				CreationTime:   parseJSONTime(ident.CreationTime),
+				ExpirationTime: parseJSONTime(ident.ExpirationTime),
+				Flags:          ident.Flags.indexFlags(),
+			})
+		}
+
+		for _, sk := range k.Subkeys {
+			fingerprint, err := parseJSONFingerprint(sk.Fingerprint)
+			if err != nil {
+				return keys, err
+			}
+
+			var usage IndexUsage
+			for _, name := range sk.Usage {
+				for _, u := range usageNames {
+					if name == u.name {
+						usage |= u.usage
+					}
+				}
+			}
+
+			key.Subkeys = append(key.Subkeys, IndexSubkey{
+				CreationTime:   parseJSONTime(sk.CreationTime),
+				ExpirationTime: parseJSONTime(sk.ExpirationTime),
+				Algo:           packet.PublicKeyAlgorithm(sk.Algo),
+				Fingerprint:    fingerprint,
+				BitLength:      sk.BitLength,
+				Curve:          sk.Curve,
+				Flags:          sk.Flags.indexFlags(),
+				Usage:          usage,
+			})
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// acceptsMediaType checks whether the Accept header of an HTTP request
+// explicitly lists the provided media type, including its parameters.
+func acceptsMediaType(r *http.Request, mediaType string) bool {
+	want, wantParams, _ := mime.ParseMediaType(mediaType)
+	for _, v := range r.Header.Values("Accept") {
+		for _, s := range strings.Split(v, ",") {
+			t, params, err := mime.ParseMediaType(strings.TrimSpace(s))
+			if err == nil && t == want && hasParams(params, wantParams) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasParams(params, want map[string]string) bool {
+	for k, v := range want {
+		if params[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// hasMediaType checks whether an HTTP response has the provided media type.
+func hasMediaType(resp *http.Response, mediaType string) bool {
+	t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && t == mediaType
+}
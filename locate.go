@@ -0,0 +1,174 @@
+package hkp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// defaultLocateTimeout is the default timeout of a key source queried by
+// Locator.
+const defaultLocateTimeout = 10 * time.Second
+
+// KeySource is a mechanism to discover the keys of an email address. If no
+// key is found, ErrNotFound is returned.
+type KeySource interface {
+	LocateKey(ctx context.Context, email string) (openpgp.EntityList, error)
+}
+
+var (
+	_ KeySource = (*Client)(nil)
+	_ KeySource = (*WKDClient)(nil)
+	_ KeySource = (*DANEClient)(nil)
+	_ KeySource = KeyRing(nil)
+)
+
+// LocateKey implements KeySource by searching the keyserver for an exact
+// email address.
+func (c *Client) LocateKey(ctx context.Context, email string) (openpgp.EntityList, error) {
+	return c.GetContext(ctx, &LookupRequest{Search: email, Exact: true})
+}
+
+// LocateKey implements KeySource.
+func (c *WKDClient) LocateKey(ctx context.Context, email string) (openpgp.EntityList, error) {
+	return c.GetContext(ctx, email)
+}
+
+// LocateKey implements KeySource.
+func (c *DANEClient) LocateKey(ctx context.Context, email string) (openpgp.EntityList, error) {
+	return c.GetContext(ctx, email)
+}
+
+// KeyRing is a local keyring, e.g. read with openpgp.ReadKeyRing.
+type KeyRing openpgp.EntityList
+
+// LocateKey implements KeySource.
+func (kr KeyRing) LocateKey(ctx context.Context, email string) (openpgp.EntityList, error) {
+	el := filterEmail(openpgp.EntityList(kr), email, time.Now())
+	if len(el) == 0 {
+		return nil, ErrNotFound
+	}
+	return el, nil
+}
+
+// hasEmail checks whether an entity has a valid user ID with the provided
+// email address. Revoked and expired entities are rejected.
+func hasEmail(e *openpgp.Entity, email string, now time.Time) bool {
+	if e.Revoked(now) {
+		return false
+	}
+	if sig := primarySelfSignature(e); sig != nil {
+		expires := keyExpirationTime(e.PrimaryKey, sig)
+		if !expires.IsZero() && !now.Before(expires) {
+			return false
+		}
+	}
+
+	for _, ident := range e.Identities {
+		if ident.UserId == nil || ident.Revoked(now) {
+			continue
+		}
+		if strings.EqualFold(ident.UserId.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterEmail(el openpgp.EntityList, email string, now time.Time) openpgp.EntityList {
+	var filtered openpgp.EntityList
+	for _, e := range el {
+		if hasEmail(e, email, now) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// LocatorSource is a key source used by Locator.
+type LocatorSource struct {
+	// Name identifies the source in errors, e.g. "wkd".
+	Name   string
+	Source KeySource
+	// Timeout is the maximum duration of a lookup. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// SourceError is an error returned by a key source.
+type SourceError struct {
+	Name string
+	Err  error
+}
+
+// Error implements error.
+func (err *SourceError) Error() string {
+	return fmt.Sprintf("hkp: key source %q: %v", err.Name, err.Err)
+}
+
+// Unwrap returns the underlying error.
+func (err *SourceError) Unwrap() error {
+	return err.Err
+}
+
+// Locator discovers the keys of an email address by querying key sources in
+// order, like GnuPG's auto-key-locate.
+//
+// Keys returned by sources are validated: only keys with a non-revoked user
+// ID matching the requested email address are kept. The keys of the first
+// source returning at least one valid key are returned.
+type Locator struct {
+	Sources []LocatorSource
+}
+
+// Locate discovers the keys of an email address.
+func (l *Locator) Locate(email string) (openpgp.EntityList, error) {
+	return l.LocateContext(context.Background(), email)
+}
+
+// LocateContext is like Locate, but with a context.
+//
+// If no source returns a valid key, ErrNotFound is returned if all sources
+// have replied that no key matches, otherwise the errors of the failed
+// sources are joined.
+func (l *Locator) LocateContext(ctx context.Context, email string) (openpgp.EntityList, error) {
+	var errs []error
+	for _, src := range l.Sources {
+		el, err := l.locate(ctx, &src, email)
+		if err == nil {
+			return el, nil
+		} else if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != ErrNotFound {
+			errs = append(errs, &SourceError{Name: src.Name, Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrNotFound
+}
+
+func (l *Locator) locate(ctx context.Context, src *LocatorSource, email string) (openpgp.EntityList, error) {
+	timeout := src.Timeout
+	if timeout <= 0 {
+		timeout = defaultLocateTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	el, err := src.Source.LocateKey(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	el = filterEmail(el, email, time.Now())
+	if len(el) == 0 {
+		return nil, ErrNotFound
+	}
+	return el, nil
+}
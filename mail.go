@@ -0,0 +1,127 @@
+package hkp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+const verificationSubject = "Verify your email address"
+
+func writeHeader(w io.Writer, h textproto.MIMEHeader, keys []string) error {
+	for _, k := range keys {
+		for _, v := range h[k] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// WriteVerificationMessage writes an RFC 5322 message containing a
+// verification URL to w. The message is encrypted with PGP/MIME (RFC 3156)
+// to the key being verified, so that only the key holder can complete the
+// verification.
+//
+// The result can be sent with any Mailer implementation.
+//
+// The email address comes from an uploaded key: an error is returned if it
+// isn't a valid address, so that it can't be used to inject header fields.
+func WriteVerificationMessage(w io.Writer, from string, v *Verification) error {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("hkp: invalid sender address %q: %v", from, err)
+	}
+	toAddr, err := mail.ParseAddress(v.Email)
+	if err != nil || toAddr.Name != "" {
+		return fmt.Errorf("hkp: invalid recipient address %q", v.Email)
+	}
+
+	mw := multipart.NewWriter(w)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("From", fromAddr.String())
+	h.Set("To", toAddr.String())
+	h.Set("Subject", mime.QEncoding.Encode("utf-8", verificationSubject))
+	h.Set("Date", time.Now().Format(time.RFC1123Z))
+	h.Set("Mime-Version", "1.0")
+	h.Set("Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": mw.Boundary(),
+	}))
+	err = writeHeader(w, h, []string{"From", "To", "Subject", "Date", "Mime-Version", "Content-Type"})
+	if err != nil {
+		return err
+	}
+
+	ph := make(textproto.MIMEHeader)
+	ph.Set("Content-Type", "application/pgp-encrypted")
+	pw, err := mw.CreatePart(ph)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(pw, "Version: 1\r\n"); err != nil {
+		return err
+	}
+
+	ph = make(textproto.MIMEHeader)
+	ph.Set("Content-Type", `application/octet-stream; name="encrypted.asc"`)
+	ph.Set("Content-Disposition", `inline; filename="encrypted.asc"`)
+	pw, err = mw.CreatePart(ph)
+	if err != nil {
+		return err
+	}
+
+	aw, err := armor.Encode(pw, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+	plaintext, err := openpgp.Encrypt(aw, []*openpgp.Entity{v.Entity}, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := writeVerificationBody(plaintext, v); err != nil {
+		return err
+	}
+	if err := plaintext.Close(); err != nil {
+		return err
+	}
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(pw, "\r\n"); err != nil {
+		return err
+	}
+
+	return mw.Close()
+}
+
+// writeVerificationBody writes the MIME entity encrypted in a verification
+// message.
+func writeVerificationBody(w io.Writer, v *Verification) error {
+	bw := bufio.NewWriter(w)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	if err := writeHeader(bw, h, []string{"Content-Type"}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bw, "Hi,\r\n\r\n")
+	fmt.Fprintf(bw, "To publish the key %X with the email address %v,\r\n", v.Entity.PrimaryKey.Fingerprint, v.Email)
+	fmt.Fprintf(bw, "please visit the following link:\r\n\r\n")
+	fmt.Fprintf(bw, "%v\r\n\r\n", v.URL)
+	fmt.Fprintf(bw, "This link expires on %v.\r\n", v.Expires.UTC().Format(time.RFC1123))
+
+	return bw.Flush()
+}
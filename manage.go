@@ -0,0 +1,486 @@
+package hkp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	challengePath = Base + "/challenge"
+	managePath    = Base + "/manage"
+)
+
+// challengeLifetime is the duration during which a challenge can be signed
+// and sent back to the server.
+const challengeLifetime = 5 * time.Minute
+
+// maxChallenges is the maximum number of pending challenges. Challenges are
+// issued to unauthenticated clients, so their number must be bounded.
+const maxChallenges = 10000
+
+var errInvalidChallenge = errors.New("hkp: invalid or expired challenge")
+
+// KeyManager is implemented by backends which allow key owners to manage
+// their published keys.
+//
+// Before calling DeleteKey, UnhideKey or IdentityRemover.RemoveIdentity,
+// Handler checks that the request has been signed by the primary key of the
+// stored key, by asking the client to sign a one-time challenge. This works
+// for keys without any email address.
+type KeyManager interface {
+	// Key returns the stored key with the specified fingerprint, even if it
+	// is hidden from lookups. If there is no such key, ErrNotFound is
+	// returned.
+	Key(fingerprint []byte) (*openpgp.Entity, error)
+	// DeleteKey deletes a key.
+	DeleteKey(fingerprint []byte) error
+	// UnhideKey publishes again a key which has been hidden from lookups.
+	UnhideKey(fingerprint []byte) error
+}
+
+// IdentityRemover is implemented by KeyManagers which allow key owners to
+// unpublish individual identities, e.g. an email address they no longer want
+// to be associated with, while keeping the rest of the key published.
+//
+// Handler removes these identities from lookup results.
+type IdentityRemover interface {
+	KeyManager
+	// RemoveIdentity hides an identity of a stored key from lookups.
+	RemoveIdentity(fingerprint []byte, name string) error
+	// RemovedIdentities returns the names of the hidden identities of a key.
+	RemovedIdentities(fingerprint []byte) ([]string, error)
+}
+
+type challengeStore struct {
+	mutex      sync.Mutex
+	challenges map[string]time.Time
+}
+
+// challengePrefix returns the part of a challenge describing the operation.
+// For identity removals, it contains a digest of the user ID.
+func challengePrefix(op string, fingerprint []byte, uid string) string {
+	prefix := fmt.Sprintf("hkp-challenge:%v:%X:", op, fingerprint)
+	if op == "remove-uid" {
+		sum := sha256.Sum256([]byte(uid))
+		prefix += base64.RawURLEncoding.EncodeToString(sum[:]) + ":"
+	}
+	return prefix
+}
+
+// newChallenge creates a challenge for an operation on a key. The challenge
+// contains the operation, the fingerprint and the user ID if any, so that a
+// signed challenge can't be used for another purpose. If too many challenges
+// are pending, ErrUnavailable is returned.
+func (cs *challengeStore) newChallenge(op string, fingerprint []byte, uid string, now time.Time) (string, error) {
+	var nonce [32]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	challenge := challengePrefix(op, fingerprint, uid) + base64.RawURLEncoding.EncodeToString(nonce[:])
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if cs.challenges == nil {
+		cs.challenges = make(map[string]time.Time)
+	}
+	if len(cs.challenges) >= maxChallenges {
+		for k, expires := range cs.challenges {
+			if now.After(expires) {
+				delete(cs.challenges, k)
+			}
+		}
+		if len(cs.challenges) >= maxChallenges {
+			return "", ErrUnavailable
+		}
+	}
+	cs.challenges[challenge] = now.Add(challengeLifetime)
+	return challenge, nil
+}
+
+// consume checks that a challenge has been issued for an operation on a key,
+// and removes it so that it can't be used twice.
+func (cs *challengeStore) consume(challenge, op string, fingerprint []byte, uid string, now time.Time) bool {
+	if !strings.HasPrefix(challenge, challengePrefix(op, fingerprint, uid)) {
+		return false
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	expires, ok := cs.challenges[challenge]
+	if !ok {
+		return false
+	}
+	delete(cs.challenges, challenge)
+	return !now.After(expires)
+}
+
+// signChallenge signs a challenge with the primary key of an entity.
+// Signing subkeys aren't used: only the primary key proves the ownership of
+// the whole key.
+func signChallenge(w io.Writer, e *openpgp.Entity, challenge string) error {
+	if e.PrivateKey == nil {
+		return errors.New("hkp: missing private primary key")
+	} else if e.PrivateKey.Encrypted {
+		return errors.New("hkp: private primary key is encrypted")
+	}
+
+	sig := &packet.Signature{
+		Version:      e.PrimaryKey.Version,
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   e.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &e.PrimaryKey.KeyId,
+	}
+	h := sig.Hash.New()
+	io.WriteString(h, challenge)
+	if err := sig.Sign(h, e.PrivateKey, nil); err != nil {
+		return err
+	}
+
+	aw, err := armor.Encode(w, "PGP SIGNATURE", nil)
+	if err != nil {
+		return err
+	}
+	if err := sig.Serialize(aw); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// checkChallengeSignature checks that an armored signature of a challenge
+// has been made by the primary key of an entity.
+func checkChallengeSignature(e *openpgp.Entity, challenge, signature string) error {
+	block, err := armor.Decode(strings.NewReader(signature))
+	if err != nil {
+		return err
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		return err
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok || sig.SigType != packet.SigTypeBinary || !sig.Hash.Available() {
+		return errors.New("hkp: invalid challenge signature")
+	}
+
+	h := sig.Hash.New()
+	io.WriteString(h, challenge)
+	return e.PrimaryKey.VerifySignature(h, sig)
+}
+
+func (h *Handler) isManageOp(op string) bool {
+	switch op {
+	case "delete", "unhide":
+		return true
+	case "remove-uid":
+		_, ok := h.KeyManager.(IdentityRemover)
+		return ok
+	default:
+		return false
+	}
+}
+
+func (h *Handler) removedIdentities(fingerprint []byte) (map[string]bool, error) {
+	ir, ok := h.KeyManager.(IdentityRemover)
+	if !ok {
+		return nil, nil
+	}
+	names, err := ir.RemovedIdentities(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	removed := make(map[string]bool, len(names))
+	for _, name := range names {
+		removed[name] = true
+	}
+	return removed, nil
+}
+
+// filterEntities removes the identities hidden with IdentityRemover from
+// lookup results. Keys which only matched the search because of a removed
+// identity are omitted.
+func (h *Handler) filterEntities(req *LookupRequest, el openpgp.EntityList) (openpgp.EntityList, error) {
+	if _, ok := h.KeyManager.(IdentityRemover); !ok {
+		return el, nil
+	}
+
+	var res openpgp.EntityList
+	for _, e := range el {
+		removed, err := h.removedIdentities(e.PrimaryKey.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if len(removed) == 0 {
+			res = append(res, e)
+			continue
+		}
+
+		filtered := *e
+		filtered.Identities = make(map[string]*openpgp.Identity)
+		var names []string
+		for name, ident := range e.Identities {
+			if !removed[name] {
+				filtered.Identities[name] = ident
+				names = append(names, name, ident.UserId.Email)
+			}
+		}
+		if matchesSearch(req, names) {
+			res = append(res, &filtered)
+		}
+	}
+	return res, nil
+}
+
+// filterIndex is like filterEntities, but for index results.
+func (h *Handler) filterIndex(req *LookupRequest, keys []IndexKey) ([]IndexKey, error) {
+	if _, ok := h.KeyManager.(IdentityRemover); !ok {
+		return keys, nil
+	}
+
+	var res []IndexKey
+	for _, key := range keys {
+		removed, err := h.removedIdentities(key.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if len(removed) == 0 {
+			res = append(res, key)
+			continue
+		}
+
+		var (
+			idents []IndexIdentity
+			names  []string
+		)
+		for _, ident := range key.Identities {
+			if !removed[ident.Name] {
+				idents = append(idents, ident)
+				names = append(names, ident.Name, parseEmail(ident.Name))
+			}
+		}
+		if matchesSearch(req, names) {
+			key.Identities = idents
+			res = append(res, key)
+		}
+	}
+	return res, nil
+}
+
+func (h *Handler) serveChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.KeyManager == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	op := r.FormValue("op")
+	if !h.isManageOp(op) {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+	fingerprint := ParseKeyIDSearch(r.FormValue("search")).Fingerprint()
+	if fingerprint == nil {
+		http.Error(w, "hkp: search must be a fingerprint", http.StatusBadRequest)
+		return
+	}
+
+	uid := r.FormValue("uid")
+	if op == "remove-uid" && uid == "" {
+		http.Error(w, "hkp: missing uid", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.KeyManager.Key(fingerprint); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	challenge, err := h.challenges.newChallenge(op, fingerprint, uid, time.Now())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, challenge)
+}
+
+func (h *Handler) serveManage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.KeyManager == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	op := r.FormValue("op")
+	if !h.isManageOp(op) {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+	fingerprint := ParseKeyIDSearch(r.FormValue("search")).Fingerprint()
+	if fingerprint == nil {
+		http.Error(w, "hkp: search must be a fingerprint", http.StatusBadRequest)
+		return
+	}
+
+	challenge := r.FormValue("challenge")
+	if !h.challenges.consume(challenge, op, fingerprint, r.FormValue("uid"), time.Now()) {
+		http.Error(w, errInvalidChallenge.Error(), http.StatusForbidden)
+		return
+	}
+
+	e, err := h.KeyManager.Key(fingerprint)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := checkChallengeSignature(e, challenge, r.FormValue("signature")); err != nil {
+		http.Error(w, "hkp: invalid challenge signature", http.StatusForbidden)
+		return
+	}
+
+	switch op {
+	case "delete":
+		err = h.KeyManager.DeleteKey(fingerprint)
+	case "unhide":
+		err = h.KeyManager.UnhideKey(fingerprint)
+	case "remove-uid":
+		name := r.FormValue("uid")
+		if _, ok := e.Identities[name]; !ok {
+			http.Error(w, "hkp: no such identity", http.StatusNotFound)
+			return
+		}
+		err = h.KeyManager.(IdentityRemover).RemoveIdentity(fingerprint, name)
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+}
+
+// postForm sends a URL-encoded form and checks the response status.
+func (c *Client) postForm(ctx context.Context, p string, v url.Values, op string) (*http.Response, error) {
+	u, err := c.url(p)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, statusError(resp, op)
+	}
+	return resp, nil
+}
+
+// manage performs a key management operation: it requests a challenge,
+// signs it with the primary key and sends it back to the server.
+func (c *Client) manage(ctx context.Context, op string, e *openpgp.Entity, params url.Values) error {
+	search := fingerprintSearch(e.PrimaryKey.Fingerprint)
+
+	v := url.Values{}
+	for k, l := range params {
+		v[k] = l
+	}
+	v.Set("op", op)
+	v.Set("search", search)
+
+	resp, err := c.postForm(ctx, challengePath, v, "get challenge")
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	challenge := string(b)
+
+	var sig bytes.Buffer
+	if err := signChallenge(&sig, e, challenge); err != nil {
+		return err
+	}
+
+	v.Set("challenge", challenge)
+	v.Set("signature", sig.String())
+
+	resp, err = c.postForm(ctx, managePath, v, op+" key")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteKey asks the keyserver to delete a key. The entity must contain the
+// private primary key, which is used to prove the ownership of the key.
+func (c *Client) DeleteKey(e *openpgp.Entity) error {
+	return c.DeleteKeyContext(context.Background(), e)
+}
+
+// DeleteKeyContext is like DeleteKey, but with a context.
+func (c *Client) DeleteKeyContext(ctx context.Context, e *openpgp.Entity) error {
+	return c.manage(ctx, "delete", e, nil)
+}
+
+// UnhideKey asks the keyserver to publish again a hidden key. The entity
+// must contain the private primary key, which is used to prove the ownership
+// of the key.
+func (c *Client) UnhideKey(e *openpgp.Entity) error {
+	return c.UnhideKeyContext(context.Background(), e)
+}
+
+// UnhideKeyContext is like UnhideKey, but with a context.
+func (c *Client) UnhideKeyContext(ctx context.Context, e *openpgp.Entity) error {
+	return c.manage(ctx, "unhide", e, nil)
+}
+
+// RemoveIdentity asks the keyserver to stop publishing an identity of a key.
+// The rest of the key remains published. The entity must contain the private
+// primary key, which is used to prove the ownership of the key.
+func (c *Client) RemoveIdentity(e *openpgp.Entity, name string) error {
+	return c.RemoveIdentityContext(context.Background(), e, name)
+}
+
+// RemoveIdentityContext is like RemoveIdentity, but with a context.
+func (c *Client) RemoveIdentityContext(ctx context.Context, e *openpgp.Entity, name string) error {
+	return c.manage(ctx, "remove-uid", e, url.Values{"uid": {name}})
+}
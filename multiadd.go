@@ -0,0 +1,226 @@
+package hkp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// TargetError is an error which occurred while uploading keys to a keyserver.
+type TargetError struct {
+	Target *Client
+	Err    error
+}
+
+// Error implements error.
+func (err *TargetError) Error() string {
+	return fmt.Sprintf("%v: %v", err.Target.Host, err.Err)
+}
+
+// Unwrap returns the underlying error.
+func (err *TargetError) Unwrap() error {
+	return err.Err
+}
+
+// MultiAddError is returned by MultiAdder when keys couldn't be uploaded to
+// enough keyservers.
+type MultiAddError struct {
+	// Errors contains an error for each keyserver which has failed.
+	Errors []*TargetError
+	// Succeeded is the number of keyservers which have accepted the keys.
+	Succeeded int
+}
+
+// Error implements error.
+func (err *MultiAddError) Error() string {
+	l := make([]string, len(err.Errors))
+	for i, targetErr := range err.Errors {
+		l[i] = targetErr.Error()
+	}
+	return fmt.Sprintf("hkp: failed to add keys to %v keyservers: %v", len(err.Errors), strings.Join(l, "; "))
+}
+
+// Unwrap returns the errors of the failed keyservers.
+func (err *MultiAddError) Unwrap() []error {
+	l := make([]error, len(err.Errors))
+	for i, targetErr := range err.Errors {
+		l[i] = targetErr
+	}
+	return l
+}
+
+// MultiAdder is an Adder which uploads keys to multiple keyservers
+// concurrently.
+//
+// If Retry is set, uploads to keyservers which have failed are retried in the
+// background, even if Add has returned successfully. Wait can be used to wait
+// for these to complete, and Close to abort them.
+type MultiAdder struct {
+	Targets []*Client
+	// Quorum is the number of keyservers which need to accept the keys for
+	// Add to succeed. If zero, all keyservers need to accept the keys.
+	Quorum int
+	// Timeout is the maximum duration of an upload to a keyserver. If zero,
+	// there is no timeout.
+	Timeout time.Duration
+
+	// Retry, if non-nil, is the policy used to retry failed uploads in the
+	// background. MinBackoff and MaxBackoff are the delays between attempts,
+	// and MaxAttempts includes the initial upload.
+	Retry *RetryPolicy
+	// RetryFailed, if non-nil, is called when a background upload has
+	// failed for the last time.
+	RetryFailed func(err *TargetError)
+
+	mutex   sync.Mutex
+	done    *sync.Cond // signaled when pending drops to zero
+	pending int
+	closed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+var _ Adder = (*MultiAdder)(nil)
+
+func (ma *MultiAdder) quorum() int {
+	if ma.Quorum <= 0 || ma.Quorum > len(ma.Targets) {
+		return len(ma.Targets)
+	}
+	return ma.Quorum
+}
+
+// init initializes the background upload state. The mutex must be held.
+func (ma *MultiAdder) init() {
+	if ma.ctx == nil {
+		ma.ctx, ma.cancel = context.WithCancel(context.Background())
+		ma.done = sync.NewCond(&ma.mutex)
+	}
+}
+
+// startRetry schedules a background retry for a failed upload. It returns
+// false if the MultiAdder has been closed.
+func (ma *MultiAdder) startRetry(targetErr *TargetError, b []byte) bool {
+	ma.mutex.Lock()
+	defer ma.mutex.Unlock()
+	if ma.closed {
+		return false
+	}
+	ma.init()
+	ma.pending++
+	go ma.retry(ma.ctx, targetErr, b)
+	return true
+}
+
+// add uploads serialized keys to a keyserver. Keys are parsed again for each
+// upload because entities can't be serialized concurrently.
+func (ma *MultiAdder) add(ctx context.Context, c *Client, b []byte) error {
+	el, err := readKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	if ma.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ma.Timeout)
+		defer cancel()
+	}
+	return c.AddContext(ctx, el)
+}
+
+// Add implements Adder.
+func (ma *MultiAdder) Add(el openpgp.EntityList) error {
+	return ma.AddContext(context.Background(), el)
+}
+
+// AddContext is like Add, but with a context. The context doesn't apply to
+// background retries.
+func (ma *MultiAdder) AddContext(ctx context.Context, el openpgp.EntityList) error {
+	var b bytes.Buffer
+	if err := serializeKeyRing(&b, el); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(ma.Targets))
+	var wg sync.WaitGroup
+	for i, c := range ma.Targets {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			errs[i] = ma.add(ctx, c, b.Bytes())
+		}(i, c)
+	}
+	wg.Wait()
+
+	var multiErr MultiAddError
+	for i, err := range errs {
+		if err == nil {
+			multiErr.Succeeded++
+			continue
+		}
+
+		targetErr := &TargetError{Target: ma.Targets[i], Err: err}
+		multiErr.Errors = append(multiErr.Errors, targetErr)
+		if ma.Retry != nil && ma.Retry.MaxAttempts > 1 {
+			ma.startRetry(targetErr, b.Bytes())
+		}
+	}
+
+	if multiErr.Succeeded < ma.quorum() {
+		return &multiErr
+	}
+	return nil
+}
+
+// retry retries a failed upload in the background.
+func (ma *MultiAdder) retry(ctx context.Context, targetErr *TargetError, b []byte) {
+	defer func() {
+		ma.mutex.Lock()
+		ma.pending--
+		if ma.pending == 0 {
+			ma.done.Broadcast()
+		}
+		ma.mutex.Unlock()
+	}()
+
+	err := targetErr.Err
+	for attempt := 1; attempt < ma.Retry.MaxAttempts; attempt++ {
+		if sleepContext(ctx, ma.Retry.backoff(attempt-1)) != nil {
+			err = ctx.Err()
+			break
+		}
+		if err = ma.add(ctx, targetErr.Target, b); err == nil {
+			return
+		}
+	}
+
+	if ma.RetryFailed != nil {
+		ma.RetryFailed(&TargetError{Target: targetErr.Target, Err: err})
+	}
+}
+
+// Wait waits for background uploads to complete.
+func (ma *MultiAdder) Wait() {
+	ma.mutex.Lock()
+	defer ma.mutex.Unlock()
+	for ma.pending > 0 {
+		ma.done.Wait()
+	}
+}
+
+// Close aborts background uploads and waits for them to return. Failed
+// uploads aren't retried after Close has been called.
+func (ma *MultiAdder) Close() error {
+	ma.mutex.Lock()
+	ma.closed = true
+	ma.init()
+	ma.cancel()
+	ma.mutex.Unlock()
+
+	ma.Wait()
+	return nil
+}
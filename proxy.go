@@ -0,0 +1,236 @@
+package hkp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// defaultProxyTimeout is the default timeout for requests sent by
+// ProxyLookuper to upstream keyservers.
+const defaultProxyTimeout = 10 * time.Second
+
+// ProxyLookuper is a Lookuper which answers lookups from a local backend and,
+// when no key is found locally, from upstream keyservers.
+//
+// Upstream keyservers are queried concurrently. Keys which don't match the
+// request are dropped, since upstream keyservers aren't trusted. Results are
+// merged: keys returned by several keyservers are only included once, with
+// the union of their identities, subkeys and signatures.
+type ProxyLookuper struct {
+	// Local, if non-nil, is queried before upstream keyservers.
+	Local     Lookuper
+	Upstreams []*Client
+	// Timeout is the maximum duration of a request to an upstream keyserver.
+	// Defaults to 10 seconds.
+	Timeout time.Duration
+	// WriteThrough, if non-nil, is used to store keys fetched from upstream
+	// keyservers, e.g. in the local backend. Errors when storing keys don't
+	// cause lookups to fail.
+	WriteThrough Adder
+	// WriteThroughFailed, if non-nil, is called when storing keys with
+	// WriteThrough has failed.
+	WriteThroughFailed func(err error)
+}
+
+var _ Lookuper = (*ProxyLookuper)(nil)
+
+func (pl *ProxyLookuper) timeout() time.Duration {
+	if pl.Timeout <= 0 {
+		return defaultProxyTimeout
+	}
+	return pl.Timeout
+}
+
+// queryUpstreams calls f concurrently for each upstream keyserver. If all
+// calls fail, an error is returned: ErrNotFound if at least one keyserver
+// has replied that no key matches, otherwise the first error. Unreachable
+// keyservers are thus ignored if others are available.
+func (pl *ProxyLookuper) queryUpstreams(f func(ctx context.Context, i int, c *Client) error) error {
+	errs := make([]error, len(pl.Upstreams))
+	var wg sync.WaitGroup
+	for i, c := range pl.Upstreams {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), pl.timeout())
+			defer cancel()
+			errs[i] = f(ctx, i, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	var err error
+	for _, e := range errs {
+		if e == nil {
+			return nil
+		} else if err == nil || errors.Is(e, ErrNotFound) {
+			err = e
+		}
+	}
+	if err == nil {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Get implements Lookuper.
+func (pl *ProxyLookuper) Get(req *LookupRequest) (openpgp.EntityList, error) {
+	if pl.Local != nil {
+		el, err := pl.Local.Get(req)
+		if err == nil && len(el) > 0 {
+			return el, nil
+		} else if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+
+	results := make([]openpgp.EntityList, len(pl.Upstreams))
+	err := pl.queryUpstreams(func(ctx context.Context, i int, c *Client) error {
+		el, err := c.GetContext(ctx, req)
+		results[i] = el
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		el    openpgp.EntityList
+		byFpr = make(map[string]*openpgp.Entity)
+	)
+	for _, res := range results {
+		for _, e := range res {
+			if !entityMatchesRequest(e, req) {
+				continue
+			}
+			k := string(e.PrimaryKey.Fingerprint)
+			if dst, ok := byFpr[k]; ok {
+				MergeEntity(dst, e)
+			} else {
+				byFpr[k] = e
+				el = append(el, e)
+			}
+		}
+	}
+	if len(el) == 0 {
+		return nil, ErrNotFound
+	}
+
+	if pl.WriteThrough != nil {
+		if err := pl.WriteThrough.Add(el); err != nil && pl.WriteThroughFailed != nil {
+			pl.WriteThroughFailed(err)
+		}
+	}
+
+	return el, nil
+}
+
+// entityMatchesRequest checks whether an entity matches a lookup request.
+// Key ID searches match the primary key and subkeys.
+func entityMatchesRequest(e *openpgp.Entity, req *LookupRequest) bool {
+	if search := ParseKeyIDSearch(req.Search); search != nil {
+		if keyMatchesKeyIDSearch(e.PrimaryKey, search) {
+			return true
+		}
+		for _, sk := range e.Subkeys {
+			if keyMatchesKeyIDSearch(sk.PublicKey, search) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var names []string
+	for name, ident := range e.Identities {
+		names = append(names, name, ident.UserId.Email)
+	}
+	return matchesSearch(req, names)
+}
+
+func keyMatchesKeyIDSearch(pk *packet.PublicKey, search KeyIDSearch) bool {
+	if fingerprint := search.Fingerprint(); fingerprint != nil {
+		return bytes.Equal(pk.Fingerprint, fingerprint)
+	} else if keyID := search.KeyId(); keyID != nil {
+		return pk.KeyId == *keyID
+	} else if keyID := search.KeyIdShort(); keyID != nil {
+		return uint32(pk.KeyId) == *keyID
+	}
+	return false
+}
+
+// Index implements Lookuper.
+func (pl *ProxyLookuper) Index(req *LookupRequest) ([]IndexKey, error) {
+	if pl.Local != nil {
+		keys, err := pl.Local.Index(req)
+		if err == nil && len(keys) > 0 {
+			return keys, nil
+		} else if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+
+	results := make([][]IndexKey, len(pl.Upstreams))
+	err := pl.queryUpstreams(func(ctx context.Context, i int, c *Client) error {
+		keys, err := c.IndexContext(ctx, req)
+		results[i] = keys
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		keys  []IndexKey
+		byFpr = make(map[string]int)
+	)
+	for _, res := range results {
+		for _, key := range res {
+			k := string(key.Fingerprint)
+			if i, ok := byFpr[k]; ok {
+				mergeIndexKey(&keys[i], &key)
+			} else {
+				byFpr[k] = len(keys)
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrNotFound
+	}
+	return keys, nil
+}
+
+// mergeIndexKey adds the identities and subkeys of src missing from dst.
+func mergeIndexKey(dst, src *IndexKey) {
+	for _, srcIdent := range src.Identities {
+		found := false
+		for _, dstIdent := range dst.Identities {
+			if dstIdent.Name == srcIdent.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.Identities = append(dst.Identities, srcIdent)
+		}
+	}
+
+	for _, srcSubkey := range src.Subkeys {
+		found := false
+		for _, dstSubkey := range dst.Subkeys {
+			if bytes.Equal(dstSubkey.Fingerprint, srcSubkey.Fingerprint) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.Subkeys = append(dst.Subkeys, srcSubkey)
+		}
+	}
+}
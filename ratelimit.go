@@ -0,0 +1,184 @@
+package hkp
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is the configuration of a token bucket: up to Burst requests can be
+// sent at once, then one request per Interval. A zero Rate doesn't limit
+// requests.
+type Rate struct {
+	Burst    int
+	Interval time.Duration
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take tries to remove a token from the bucket. If the bucket is empty, it
+// returns the time to wait until a token is available.
+func (b *tokenBucket) take(rate Rate, now time.Time) (bool, time.Duration) {
+	b.refill(rate, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(rate.Interval))
+}
+
+func (b *tokenBucket) refill(rate Rate, now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+float64(elapsed)/float64(rate.Interval))
+}
+
+type rateLimitClass int
+
+const (
+	rateLimitLookup rateLimitClass = iota
+	rateLimitAdd
+)
+
+type rateLimitKey struct {
+	class rateLimitClass
+	addr  netip.Addr
+}
+
+// rateLimitCleanupInterval is the interval at which idle buckets are removed.
+const rateLimitCleanupInterval = time.Minute
+
+// RateLimiter limits requests per client IP address. Lookups and uploads
+// have separate budgets.
+//
+// When a client exceeds its budget, Handler replies with 429 Too Many
+// Requests and a Retry-After header field.
+type RateLimiter struct {
+	Lookup Rate
+	Add    Rate
+	// TrustedProxies is a list of reverse proxy networks. For requests
+	// coming from these, the client address is read from the
+	// X-Forwarded-For header field.
+	TrustedProxies []netip.Prefix
+
+	mutex       sync.Mutex
+	buckets     map[rateLimitKey]*tokenBucket
+	lastCleanup time.Time
+}
+
+func (rl *RateLimiter) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range rl.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the IP address of the client which sent a request.
+func (rl *RateLimiter) clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+
+	// Walk the proxy chain from the closest hop, until an untrusted address
+	// is found
+	var forwarded []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0 && rl.isTrustedProxy(addr); i-- {
+		next, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = next.Unmap()
+	}
+
+	return addr, true
+}
+
+func (rl *RateLimiter) rate(class rateLimitClass) Rate {
+	rate := rl.Lookup
+	if class == rateLimitAdd {
+		rate = rl.Add
+	}
+	if rate.Burst < 1 {
+		rate.Burst = 1
+	}
+	return rate
+}
+
+func (rl *RateLimiter) allow(class rateLimitClass, r *http.Request) (bool, time.Duration) {
+	rate := rl.rate(class)
+	if rate.Interval <= 0 {
+		return true, 0
+	}
+
+	addr, ok := rl.clientAddr(r)
+	if !ok {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.buckets == nil {
+		rl.buckets = make(map[rateLimitKey]*tokenBucket)
+	}
+	if now.Sub(rl.lastCleanup) > rateLimitCleanupInterval {
+		rl.cleanup(now)
+	}
+
+	k := rateLimitKey{class, addr}
+	b, ok := rl.buckets[k]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rate.Burst), last: now}
+		rl.buckets[k] = b
+	}
+	return b.take(rate, now)
+}
+
+// cleanup removes full buckets, which are equivalent to missing ones.
+func (rl *RateLimiter) cleanup(now time.Time) {
+	rl.lastCleanup = now
+	for k, b := range rl.buckets {
+		rate := rl.rate(k.class)
+		b.refill(rate, now)
+		if b.tokens >= float64(rate.Burst) {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// checkRateLimit returns false and writes an error response if the client
+// has exceeded its budget.
+func (h *Handler) checkRateLimit(w http.ResponseWriter, r *http.Request, class rateLimitClass) bool {
+	if h.RateLimiter == nil {
+		return true
+	}
+
+	ok, wait := h.RateLimiter.allow(class, r)
+	if !ok {
+		sec := int64(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(sec, 10))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	}
+	return ok
+}
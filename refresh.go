@@ -0,0 +1,209 @@
+package hkp
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// RefreshChanges describes the updates merged into a key by Refresh.
+type RefreshChanges int
+
+const (
+	// RefreshNewRevocation indicates that a revocation of the key, one of
+	// its identities or one of its subkeys has been added.
+	RefreshNewRevocation RefreshChanges = 1 << iota
+	// RefreshNewSubkey indicates that a subkey has been added.
+	RefreshNewSubkey
+	// RefreshNewIdentity indicates that an identity has been added.
+	RefreshNewIdentity
+	// RefreshExpirationChanged indicates that the expiration time of the key
+	// or one of its subkeys has changed.
+	RefreshExpirationChanged
+)
+
+// RefreshResult is the result of refreshing a single key.
+type RefreshResult struct {
+	Entity  *openpgp.Entity
+	Changes RefreshChanges
+	// Err is set if the key couldn't be refreshed. It's ErrNotFound if the
+	// keyserver doesn't know about the key.
+	Err error
+}
+
+// RefreshOptions contains options for Refresh.
+type RefreshOptions struct {
+	// MaxDelay is the maximum random delay to wait for before each request.
+	// Together with the randomized request order, this prevents the
+	// keyserver from learning which keys belong to the same key ring.
+	MaxDelay time.Duration
+}
+
+// Refresh updates the keys of a key ring with the revocations, identities,
+// subkeys and expiration times known to a keyserver, like gpg's
+// --refresh-keys.
+//
+// Keys are fetched by full fingerprint and updates are merged in place. A
+// result is returned for each key, in the order of the key ring. The returned
+// error is only set if the context is done before all keys are refreshed.
+func Refresh(ctx context.Context, c *Client, el openpgp.EntityList, options *RefreshOptions) ([]RefreshResult, error) {
+	if options == nil {
+		options = new(RefreshOptions)
+	}
+
+	results := make([]RefreshResult, len(el))
+	for i, e := range el {
+		results[i].Entity = e
+	}
+
+	for _, i := range rand.Perm(len(el)) {
+		if options.MaxDelay > 0 {
+			delay := time.Duration(rand.Int63n(int64(options.MaxDelay)))
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return results, ctx.Err()
+			}
+		}
+
+		results[i].Changes, results[i].Err = refreshEntity(ctx, c, el[i])
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+func refreshEntity(ctx context.Context, c *Client, e *openpgp.Entity) (RefreshChanges, error) {
+	req := LookupRequest{
+		Search: fingerprintSearch(e.PrimaryKey.Fingerprint),
+		Exact:  true,
+	}
+	el, err := c.GetContext(ctx, &req)
+	if err != nil {
+		return 0, err
+	}
+
+	var changes RefreshChanges
+	found := false
+	for _, remote := range el {
+		if bytes.Equal(remote.PrimaryKey.Fingerprint, e.PrimaryKey.Fingerprint) {
+			changes |= MergeEntity(e, remote)
+			found = true
+		}
+	}
+	if !found {
+		return 0, ErrNotFound
+	}
+	return changes, nil
+}
+
+func serializeSignature(sig *packet.Signature) string {
+	var b bytes.Buffer
+	if err := sig.Serialize(&b); err != nil {
+		return ""
+	}
+	return b.String()
+}
+
+// mergeSignatures appends the signatures of src missing from dst. It returns
+// the merged list and the number of signatures added.
+func mergeSignatures(dst, src []*packet.Signature) ([]*packet.Signature, int) {
+	known := make(map[string]bool, len(dst))
+	for _, sig := range dst {
+		known[serializeSignature(sig)] = true
+	}
+
+	n := 0
+	for _, sig := range src {
+		k := serializeSignature(sig)
+		if !known[k] {
+			known[k] = true
+			dst = append(dst, sig)
+			n++
+		}
+	}
+	return dst, n
+}
+
+// MergeEntity merges the identities, subkeys and signatures of src into dst,
+// and returns the changes made to dst. Both entities must have the same
+// primary key. Nothing is ever removed from dst.
+//
+// Backends can use it to update stored keys when a known key is uploaded
+// again, so that signatures such as revocations can't be removed.
+//
+// src may be untrusted, e.g. uploaded by anyone. MergeEntity doesn't verify
+// signatures itself: src must have been read with openpgp.ReadEntity or
+// openpgp.ReadKeyRing, which drop invalid self-signatures, binding signatures
+// and revocations. Third-party certifications aren't verified and are merged
+// as-is. After the call, dst shares packets with src, so src must not be
+// modified.
+func MergeEntity(dst, src *openpgp.Entity) RefreshChanges {
+	var changes RefreshChanges
+
+	prevExpirationTime := keyExpirationTime(dst.PrimaryKey, primarySelfSignature(dst))
+
+	var n int
+	dst.Revocations, n = mergeSignatures(dst.Revocations, src.Revocations)
+	if n > 0 {
+		changes |= RefreshNewRevocation
+	}
+
+	for name, srcIdent := range src.Identities {
+		dstIdent, ok := dst.Identities[name]
+		if !ok {
+			dst.Identities[name] = srcIdent
+			changes |= RefreshNewIdentity
+			continue
+		}
+
+		dstIdent.Signatures, _ = mergeSignatures(dstIdent.Signatures, srcIdent.Signatures)
+		dstIdent.Revocations, n = mergeSignatures(dstIdent.Revocations, srcIdent.Revocations)
+		if n > 0 {
+			changes |= RefreshNewRevocation
+		}
+		if srcIdent.SelfSignature != nil && (dstIdent.SelfSignature == nil || srcIdent.SelfSignature.CreationTime.After(dstIdent.SelfSignature.CreationTime)) {
+			dstIdent.SelfSignature = srcIdent.SelfSignature
+		}
+	}
+
+	if !keyExpirationTime(dst.PrimaryKey, primarySelfSignature(dst)).Equal(prevExpirationTime) {
+		changes |= RefreshExpirationChanged
+	}
+
+	for _, srcSubkey := range src.Subkeys {
+		var dstSubkey *openpgp.Subkey
+		for i := range dst.Subkeys {
+			if bytes.Equal(dst.Subkeys[i].PublicKey.Fingerprint, srcSubkey.PublicKey.Fingerprint) {
+				dstSubkey = &dst.Subkeys[i]
+				break
+			}
+		}
+		if dstSubkey == nil {
+			dst.Subkeys = append(dst.Subkeys, srcSubkey)
+			changes |= RefreshNewSubkey
+			continue
+		}
+
+		dstSubkey.Revocations, n = mergeSignatures(dstSubkey.Revocations, srcSubkey.Revocations)
+		if n > 0 {
+			changes |= RefreshNewRevocation
+		}
+		if srcSubkey.Sig.CreationTime.After(dstSubkey.Sig.CreationTime) {
+			if !keyExpirationTime(dstSubkey.PublicKey, srcSubkey.Sig).Equal(keyExpirationTime(dstSubkey.PublicKey, dstSubkey.Sig)) {
+				changes |= RefreshExpirationChanged
+			}
+			dstSubkey.Sig = srcSubkey.Sig
+		}
+	}
+
+	return changes
+}
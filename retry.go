@@ -0,0 +1,158 @@
+package hkp
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRetryAfter is the delay sent by Handler in the Retry-After header
+// field when the backend is rate-limiting or unavailable.
+const defaultRetryAfter = time.Minute
+
+// RetryPolicy describes how Client retries failed requests.
+//
+// Requests are retried on network errors and on 429, 502, 503 and 504
+// responses, with exponential backoff and jitter. The Retry-After header
+// field is honored.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry. Defaults to one second.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum delay between two attempts. If a server asks
+	// to wait longer with Retry-After, the request isn't retried. Defaults
+	// to one minute.
+	MaxBackoff time.Duration
+	// RetryNonIdempotent enables retries for non-idempotent operations, such
+	// as uploads.
+	RetryNonIdempotent bool
+}
+
+func (policy *RetryPolicy) maxBackoff() time.Duration {
+	if policy.MaxBackoff <= 0 {
+		return time.Minute
+	}
+	return policy.MaxBackoff
+}
+
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	min, max := policy.MinBackoff, policy.maxBackoff()
+	if min <= 0 {
+		min = time.Second
+	}
+
+	d := min << uint(attempt)
+	if d > max || d <= 0 {
+		d = max
+	}
+	// Pick a random delay in [d/2, d)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRetryAfter parses a Retry-After header field value, which can be
+// either a number of seconds or an HTTP date.
+func parseRetryAfter(s string, now time.Time) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// doRetry sends an HTTP request, retrying according to the client's retry
+// policy.
+func (c *Client) doRetry(req *http.Request, idempotent bool) (*http.Response, error) {
+	policy := c.Retry
+	if policy == nil || policy.MaxAttempts <= 1 || (!idempotent && !policy.RetryNonIdempotent) {
+		return c.send(req)
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return c.send(req)
+	}
+
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := c.send(req)
+		last := attempt+1 >= policy.MaxAttempts
+		if err != nil {
+			if last || ctx.Err() != nil {
+				return nil, err
+			}
+		} else if last || !isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+
+		delay := policy.backoff(attempt)
+		if resp != nil {
+			if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if d > policy.maxBackoff() {
+					return resp, nil
+				}
+				delay = d
+			}
+			resp.Body.Close()
+		}
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// statusError converts a failed HTTP response into an error.
+func statusError(resp *http.Response, op string) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusServiceUnavailable:
+		return ErrUnavailable
+	default:
+		return fmt.Errorf("hkp: failed to %v: %v %v", op, resp.StatusCode, resp.Status)
+	}
+}
@@ -1,9 +1,14 @@
 package hkp
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 )
@@ -11,6 +16,20 @@ import (
 var (
 	ErrNotFound  = errors.New("hkp: not found")
 	ErrForbidden = errors.New("hkp: forbidden")
+	// ErrRateLimited indicates that too many requests have been sent. Handler
+	// replies with 429 Too Many Requests.
+	ErrRateLimited = errors.New("hkp: rate limited")
+	// ErrUnavailable indicates that the keyserver is temporarily unable to
+	// process requests. Handler replies with 503 Service Unavailable.
+	ErrUnavailable = errors.New("hkp: service unavailable")
+)
+
+const (
+	// maxUploadSize is the maximum size of an upload request body.
+	maxUploadSize = 32 << 20
+	// maxUploadMemory is the maximum number of bytes of an uploaded
+	// multipart form stored in memory. The rest is stored on disk.
+	maxUploadMemory = 8 << 20
 )
 
 type Lookuper interface {
@@ -23,11 +42,20 @@ type Adder interface {
 }
 
 func httpError(w http.ResponseWriter, err error) {
-	switch err {
-	case ErrNotFound:
+	retryAfter := strconv.Itoa(int(defaultRetryAfter / time.Second))
+	switch {
+	case errors.Is(err, ErrNotFound):
 		http.NotFound(w, nil)
-	case ErrForbidden:
+	case errors.Is(err, ErrUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, ErrForbidden):
 		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrRateLimited):
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ErrUnavailable):
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 	default:
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -36,10 +64,63 @@ func httpError(w http.ResponseWriter, err error) {
 type Handler struct {
 	Lookuper Lookuper
 	Adder    Adder
+
+	// CacheMaxAge is the duration during which clients are allowed to cache
+	// lookup results. If zero, no Cache-Control header field is sent.
+	CacheMaxAge time.Duration
+	// RateLimiter, if non-nil, limits the number of requests per client.
+	RateLimiter *RateLimiter
+	// Authenticator, if non-nil, is used to authenticate uploads.
+	Authenticator Authenticator
+	// Verifier, if non-nil, handles email address verification requests.
+	Verifier *Verifier
+	// KeyManager, if non-nil, allows key owners to delete and unhide their
+	// keys by signing a challenge. If it implements IdentityRemover, key
+	// owners can also remove individual identities.
+	KeyManager KeyManager
+
+	challenges challengeStore
+}
+
+func (h *Handler) writeKeys(w http.ResponseWriter, r *http.Request, el openpgp.EntityList, opts *LookupOptions, modTime time.Time) {
+	var (
+		b   bytes.Buffer
+		err error
+	)
+	if opts.Binary {
+		w.Header().Set("Content-Type", binaryMediaType)
+		err = serializeKeyRing(&b, el)
+	} else {
+		w.Header().Set("Content-Type", keysMediaType)
+		err = serializeArmoredKeyRing(&b, el)
+	}
+	if err != nil {
+		panic(err)
+	}
+	h.serveLookupResult(w, r, b.Bytes(), modTime)
+}
+
+func (h *Handler) writeIndex(w http.ResponseWriter, r *http.Request, keys []IndexKey, opts *LookupOptions, modTime time.Time) {
+	var (
+		b   bytes.Buffer
+		err error
+	)
+	if opts.JSON {
+		w.Header().Set("Content-Type", jsonMediaType)
+		err = WriteIndexJSON(&b, keys)
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+		err = writeIndex(&b, keys)
+	}
+	if err != nil {
+		panic(err)
+	}
+	h.serveLookupResult(w, r, b.Bytes(), modTime)
 }
 
 func (h *Handler) serveLookup(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	// POST is only useful for batch requests, which may not fit in a URL
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -48,17 +129,37 @@ func (h *Handler) serveLookup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	q := r.URL.Query()
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.Form
+
+	w.Header().Set(batchHeader, "get")
 
 	req := LookupRequest{
 		Search:  q.Get("search"),
 		Options: *parseLookupOptions(q.Get("options")),
 		Exact:   q.Get("exact") == "on",
 	}
+	if acceptsMediaType(r, jsonMediaType) {
+		req.Options.JSON = true
+	}
+	if acceptsMediaType(r, binaryMediaType) {
+		req.Options.Binary = true
+	}
 
 	switch q.Get("op") {
 	case "get":
+		if searches := q["search"]; len(searches) > 1 {
+			h.serveBatchGet(w, r, &req, searches)
+			return
+		}
+
 		el, err := h.Lookuper.Get(&req)
+		if err == nil {
+			el, err = h.filterEntities(&req, el)
+		}
 		if err != nil {
 			httpError(w, err)
 			return
@@ -66,20 +167,30 @@ func (h *Handler) serveLookup(w http.ResponseWriter, r *http.Request) {
 			http.NotFound(w, r)
 			return
 		}
-		w.Header().Set("Content-Type", "application/pgp-keys")
-		if err := serializeArmoredKeyRing(w, el); err != nil {
-			panic(err)
+		modTime, err := h.modTime(&req)
+		if err != nil {
+			httpError(w, err)
+			return
 		}
+		h.writeKeys(w, r, el, &req.Options, modTime)
 	case "index", "vindex":
 		res, err := h.Lookuper.Index(&req)
+		if err == nil && len(res) > 0 {
+			res, err = h.filterIndex(&req, res)
+			if err == nil && len(res) == 0 {
+				err = ErrNotFound
+			}
+		}
 		if err != nil {
 			httpError(w, err)
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain")
-		if err := writeIndex(w, res); err != nil {
-			panic(err)
+		modTime, err := h.modTime(&req)
+		if err != nil {
+			httpError(w, err)
+			return
 		}
+		h.writeIndex(w, r, res, &req.Options, modTime)
 	default:
 		http.Error(w, "Not Implemented", http.StatusNotImplemented)
 	}
@@ -95,17 +206,39 @@ func (h *Handler) serveAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
+	principal, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// Binary keys are uploaded as a file in a multipart form
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(maxUploadMemory)
+	} else {
+		err = r.ParseForm()
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		httpError(w, err)
 		return
 	}
 
-	s := r.FormValue("keytext")
-	if s == "" {
+	var keytext io.Reader
+	if s := r.FormValue("keytext"); s != "" {
+		keytext = strings.NewReader(s)
+	} else if f, _, err := r.FormFile("keytext"); err == nil {
+		defer f.Close()
+		keytext = f
+	} else {
 		return
 	}
 
-	el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(s))
+	el, err := readKeyRing(keytext)
 	if err != nil {
 		httpError(w, err)
 		return
@@ -113,7 +246,12 @@ func (h *Handler) serveAdd(w http.ResponseWriter, r *http.Request) {
 
 	r.Body.Close()
 
-	if err := h.Adder.Add(el); err != nil {
+	if aa, ok := h.Adder.(AuthenticatedAdder); ok && principal != nil {
+		err = aa.AddAuthenticated(principal, el)
+	} else {
+		err = h.Adder.Add(el)
+	}
+	if err != nil {
 		httpError(w, err)
 		return
 	}
@@ -123,9 +261,27 @@ func (h *Handler) serveAdd(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case lookupPath:
-		h.serveLookup(w, r)
+		if h.checkRateLimit(w, r, rateLimitLookup) {
+			h.serveLookup(w, r)
+		}
 	case addPath:
-		h.serveAdd(w, r)
+		if h.checkRateLimit(w, r, rateLimitAdd) {
+			h.serveAdd(w, r)
+		}
+	case verifyPath:
+		if h.Verifier == nil {
+			http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		} else if h.checkRateLimit(w, r, rateLimitLookup) {
+			h.Verifier.serveVerify(w, r)
+		}
+	case challengePath:
+		if h.checkRateLimit(w, r, rateLimitAdd) {
+			h.serveChallenge(w, r)
+		}
+	case managePath:
+		if h.checkRateLimit(w, r, rateLimitAdd) {
+			h.serveManage(w, r)
+		}
 	default:
 		http.Error(w, "Not Implemented", http.StatusNotImplemented)
 	}
@@ -0,0 +1,216 @@
+package hkp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTorProxy is the address of the SOCKS5 proxy of a local Tor daemon.
+const DefaultTorProxy = "127.0.0.1:9050"
+
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthUnacceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+)
+
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// isOnion checks whether a host is a Tor onion service.
+func isOnion(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".onion")
+}
+
+// socksDialer connects to hosts through a SOCKS5 proxy (RFC 1928). Host
+// names are resolved by the proxy.
+type socksDialer struct {
+	proxyAddr string
+	// isolate enables stream isolation: each connection uses unique
+	// credentials (RFC 1929), so that Tor routes it over a separate circuit.
+	isolate bool
+}
+
+func (d *socksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		// OK
+	default:
+		return nil, fmt.Errorf("hkp: unsupported network %q for SOCKS5 proxy", network)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("hkp: failed to connect to SOCKS5 proxy: %v", err)
+	}
+
+	// Abort the handshake if the context is cancelled
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	err = d.handshake(conn, addr)
+	close(done)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("hkp: SOCKS5 proxy: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (d *socksDialer) handshake(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socksAuthNone)
+	if d.isolate {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+
+	var buf [2]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return fmt.Errorf("unexpected protocol version %v", buf[0])
+	}
+	switch buf[1] {
+	case method:
+		// OK
+	case socksAuthUnacceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unexpected authentication method %v", buf[1])
+	}
+
+	if method == socksAuthPassword {
+		if err := socksAuthenticate(conn); err != nil {
+			return err
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long", host)
+		}
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected protocol version %v", reply[0])
+	}
+	if reply[1] != 0 {
+		if msg, ok := socksReplies[reply[1]]; ok {
+			return fmt.Errorf("failed to connect to %q: %v", addr, msg)
+		}
+		return fmt.Errorf("failed to connect to %q: unknown error %v", addr, reply[1])
+	}
+
+	// Discard the bound address and port
+	var n int
+	switch reply[3] {
+	case socksAddrIPv4:
+		n = net.IPv4len
+	case socksAddrIPv6:
+		n = net.IPv6len
+	case socksAddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %v", reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(n)+2)
+	return err
+}
+
+// socksAuthenticate sends random credentials.
+func socksAuthenticate(conn net.Conn) error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	username := hex.EncodeToString(b[:8])
+	password := hex.EncodeToString(b[8:])
+
+	req := []byte{0x01, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package hkp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PinError is returned when the certificate chain of a keyserver doesn't
+// contain any of the public keys pinned in Client.PinnedSPKI.
+type PinError struct {
+	ServerName string
+	// SPKI contains the base64-encoded SHA-256 digests of the public keys
+	// of the verified certificate chains of the keyserver.
+	SPKI []string
+}
+
+// Error implements error.
+func (err *PinError) Error() string {
+	return fmt.Sprintf("hkp: TLS certificate of %q doesn't match any pinned public key (got %v)", err.ServerName, strings.Join(err.SPKI, ", "))
+}
+
+// spkiHash returns the base64-encoded SHA-256 digest of the public key of a
+// certificate, in the format used by HPKP and curl.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins checks that a verified certificate chain contains a pinned
+// public key. Certificates sent by the server which aren't part of a verified
+// chain are ignored, since anyone can append them. If certificate verification
+// is disabled, only the leaf certificate is checked.
+func verifyPins(pins []string, cs *tls.ConnectionState, insecureSkipVerify bool) error {
+	var certs []*x509.Certificate
+	if insecureSkipVerify {
+		if len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+	} else {
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+
+	var got []string
+	seen := make(map[string]bool)
+	for _, cert := range certs {
+		h := spkiHash(cert)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(pin)) == 1 {
+				return nil
+			}
+		}
+		if !seen[h] {
+			seen[h] = true
+			got = append(got, h)
+		}
+	}
+	return &PinError{ServerName: cs.ServerName, SPKI: got}
+}
+
+// tlsConfig creates the TLS configuration from the client's options. base is
+// the TLS configuration of the HTTP transport, it's used unless TLSConfig is
+// set.
+func (c *Client) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	var config *tls.Config
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	} else if base != nil {
+		config = base.Clone()
+	} else {
+		config = new(tls.Config)
+	}
+
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("hkp: failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("hkp: no certificate found in CA file %q", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(c.PinnedSPKI) > 0 {
+		pins := append([]string(nil), c.PinnedSPKI...)
+		insecureSkipVerify := config.InsecureSkipVerify
+		verifyConnection := config.VerifyConnection
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verifyConnection != nil {
+				if err := verifyConnection(cs); err != nil {
+					return err
+				}
+			}
+			return verifyPins(pins, &cs, insecureSkipVerify)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,453 @@
+package hkp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const verifyPath = Base + "/verify"
+
+const (
+	tokenVersion         = 1
+	defaultTokenLifetime = 24 * time.Hour
+)
+
+// verificationInterval is the minimum duration between two verification
+// requests sent to the same email address, so that uploads can't be used to
+// flood an address.
+const verificationInterval = 15 * time.Minute
+
+var errInvalidToken = errors.New("hkp: invalid or expired verification token")
+
+// Verification is a request to confirm the ownership of an email address
+// listed in an identity of an uploaded key.
+type Verification struct {
+	Email  string
+	Entity *openpgp.Entity
+	Token  string
+	// URL is the address the owner needs to visit to confirm the email
+	// address.
+	URL     string
+	Expires time.Time
+}
+
+// Mailer sends verification requests to email addresses.
+type Mailer interface {
+	SendVerification(v *Verification) error
+}
+
+// MemoryMailer is a Mailer storing verification requests in memory, for
+// testing purposes.
+type MemoryMailer struct {
+	mutex sync.Mutex
+	sent  []*Verification
+}
+
+var _ Mailer = (*MemoryMailer)(nil)
+
+// SendVerification implements Mailer.
+func (m *MemoryMailer) SendVerification(v *Verification) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sent = append(m.sent, v)
+	return nil
+}
+
+// Sent returns the verification requests sent so far.
+func (m *MemoryMailer) Sent() []*Verification {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]*Verification(nil), m.sent...)
+}
+
+// VerifiedStore keeps track of verified email addresses.
+type VerifiedStore interface {
+	IsVerified(fingerprint []byte, email string) (bool, error)
+	SetVerified(fingerprint []byte, email string) error
+}
+
+// MemoryVerifiedStore is an in-memory VerifiedStore.
+type MemoryVerifiedStore struct {
+	mutex    sync.Mutex
+	verified map[string]bool
+}
+
+var _ VerifiedStore = (*MemoryVerifiedStore)(nil)
+
+func verifiedStoreKey(fingerprint []byte, email string) string {
+	return string(fingerprint) + "\x00" + strings.ToLower(email)
+}
+
+// IsVerified implements VerifiedStore.
+func (s *MemoryVerifiedStore) IsVerified(fingerprint []byte, email string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.verified[verifiedStoreKey(fingerprint, email)], nil
+}
+
+// SetVerified implements VerifiedStore.
+func (s *MemoryVerifiedStore) SetVerified(fingerprint []byte, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.verified == nil {
+		s.verified = make(map[string]bool)
+	}
+	s.verified[verifiedStoreKey(fingerprint, email)] = true
+	return nil
+}
+
+// Verifier only publishes identities whose email address has been confirmed
+// by its owner, like keys.openpgp.org.
+//
+// Verifier wraps a backend: it implements Lookuper and Adder. When keys are
+// added, a verification request is sent for each email address. Lookup
+// results only contain verified identities. Keys without any verified
+// identity are omitted from Get results, since OpenPGP implementations can't
+// read keys without identities. They are still listed in Index results when
+// searched by key ID or fingerprint.
+//
+// At most one verification request is sent to an email address every 15
+// minutes, whichever key it belongs to.
+//
+// To expose the verification endpoint, set Handler.Verifier.
+type Verifier struct {
+	Lookuper Lookuper
+	Adder    Adder
+	Mailer   Mailer
+	// Store keeps track of verified email addresses. If nil, they are kept
+	// in memory.
+	Store VerifiedStore
+
+	// Key is the secret used to sign verification tokens.
+	Key []byte
+	// TokenLifetime is the duration during which verification tokens are
+	// valid. Defaults to one day.
+	TokenLifetime time.Duration
+	// BaseURL is the URL of the keyserver, used to build verification URLs,
+	// e.g. "https://keys.example.org".
+	BaseURL string
+
+	memoryStore MemoryVerifiedStore
+
+	mutex       sync.Mutex
+	lastSent    map[string]time.Time // by lower-case email address
+	lastCleanup time.Time
+}
+
+var (
+	_ Lookuper = (*Verifier)(nil)
+	_ Adder    = (*Verifier)(nil)
+)
+
+func (v *Verifier) store() VerifiedStore {
+	if v.Store != nil {
+		return v.Store
+	}
+	return &v.memoryStore
+}
+
+// allowVerification checks whether a verification request can be sent to an
+// email address, and records it.
+func (v *Verifier) allowVerification(email string, now time.Time) bool {
+	email = strings.ToLower(email)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.lastSent == nil {
+		v.lastSent = make(map[string]time.Time)
+	}
+	if now.Sub(v.lastCleanup) > verificationInterval {
+		v.lastCleanup = now
+		for k, t := range v.lastSent {
+			if now.Sub(t) >= verificationInterval {
+				delete(v.lastSent, k)
+			}
+		}
+	}
+
+	if t, ok := v.lastSent[email]; ok && now.Sub(t) < verificationInterval {
+		return false
+	}
+	v.lastSent[email] = now
+	return true
+}
+
+func (v *Verifier) mac(payload []byte) []byte {
+	mac := hmac.New(sha256.New, v.Key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (v *Verifier) newToken(fingerprint []byte, email string, expires time.Time) (string, error) {
+	if len(v.Key) == 0 {
+		return "", errors.New("hkp: missing verification token key")
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(tokenVersion)
+	binary.Write(&b, binary.BigEndian, expires.Unix())
+	b.WriteByte(byte(len(fingerprint)))
+	b.Write(fingerprint)
+	b.WriteString(email)
+	b.Write(v.mac(b.Bytes()))
+	return base64.RawURLEncoding.EncodeToString(b.Bytes()), nil
+}
+
+func (v *Verifier) parseToken(token string, now time.Time) (fingerprint []byte, email string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < sha256.Size+10 || len(v.Key) == 0 {
+		return nil, "", errInvalidToken
+	}
+
+	payload, mac := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if !hmac.Equal(mac, v.mac(payload)) || payload[0] != tokenVersion {
+		return nil, "", errInvalidToken
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[1:9])), 0)
+	if now.After(expires) {
+		return nil, "", errInvalidToken
+	}
+
+	n := int(payload[9])
+	if len(payload) < 10+n {
+		return nil, "", errInvalidToken
+	}
+	return payload[10 : 10+n], string(payload[10+n:]), nil
+}
+
+// Verify marks the email address referred to by a verification token as
+// verified.
+func (v *Verifier) Verify(token string) error {
+	fingerprint, email, err := v.parseToken(token, time.Now())
+	if err != nil {
+		return err
+	}
+	return v.store().SetVerified(fingerprint, email)
+}
+
+// Add implements Adder.
+func (v *Verifier) Add(el openpgp.EntityList) error {
+	if err := v.Adder.Add(el); err != nil {
+		return err
+	}
+
+	lifetime := v.TokenLifetime
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	now := time.Now()
+	expires := now.Add(lifetime)
+
+	for _, e := range el {
+		fingerprint := e.PrimaryKey.Fingerprint
+		for _, ident := range e.Identities {
+			email := ident.UserId.Email
+			if email == "" {
+				continue
+			}
+			if ok, err := v.store().IsVerified(fingerprint, email); err != nil {
+				return err
+			} else if ok || !v.allowVerification(email, now) {
+				continue
+			}
+
+			token, err := v.newToken(fingerprint, email, expires)
+			if err != nil {
+				return err
+			}
+			err = v.Mailer.SendVerification(&Verification{
+				Email:   email,
+				Entity:  e,
+				Token:   token,
+				URL:     strings.TrimSuffix(v.BaseURL, "/") + verifyPath + "?token=" + url.QueryEscape(token),
+				Expires: expires,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (v *Verifier) isVerified(fingerprint []byte, email string) (bool, error) {
+	if email == "" {
+		return false, nil
+	}
+	return v.store().IsVerified(fingerprint, email)
+}
+
+// matchesSearch checks whether a search is still satisfied by the verified
+// identities of a key. Key ID searches always match.
+func matchesSearch(req *LookupRequest, names []string) bool {
+	if ParseKeyIDSearch(req.Search) != nil {
+		return true
+	}
+	search := strings.ToLower(req.Search)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if req.Exact && name == search || !req.Exact && strings.Contains(name, search) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get implements Lookuper.
+func (v *Verifier) Get(req *LookupRequest) (openpgp.EntityList, error) {
+	el, err := v.Lookuper.Get(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var res openpgp.EntityList
+	for _, e := range el {
+		filtered := *e
+		filtered.Identities = make(map[string]*openpgp.Identity)
+		var names []string
+		for name, ident := range e.Identities {
+			ok, err := v.isVerified(e.PrimaryKey.Fingerprint, ident.UserId.Email)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				filtered.Identities[name] = ident
+				names = append(names, name, ident.UserId.Email)
+			}
+		}
+
+		if len(filtered.Identities) > 0 && matchesSearch(req, names) {
+			res = append(res, &filtered)
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// Index implements Lookuper.
+func (v *Verifier) Index(req *LookupRequest) ([]IndexKey, error) {
+	keys, err := v.Lookuper.Index(req)
+	if err != nil {
+		return nil, err
+	}
+
+	keyIDSearch := ParseKeyIDSearch(req.Search) != nil
+	var res []IndexKey
+	for _, key := range keys {
+		var (
+			idents []IndexIdentity
+			names  []string
+		)
+		for _, ident := range key.Identities {
+			email := parseEmail(ident.Name)
+			ok, err := v.isVerified(key.Fingerprint, email)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				idents = append(idents, ident)
+				names = append(names, ident.Name, email)
+			}
+		}
+
+		if keyIDSearch || len(idents) > 0 && matchesSearch(req, names) {
+			key.Identities = idents
+			res = append(res, key)
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// parseEmail extracts the email address from an identity name of the form
+// "Full Name (comment) <email@example.org>".
+func parseEmail(name string) string {
+	start := strings.LastIndexByte(name, '<')
+	end := strings.LastIndexByte(name, '>')
+	if start >= 0 && end > start {
+		return name[start+1 : end]
+	}
+	if strings.Contains(name, "@") && !strings.ContainsAny(name, " ()<>") {
+		return name
+	}
+	return ""
+}
+
+// verifyFormTemplate is the page shown when a verification URL is visited.
+// The address is only confirmed when the form is submitted, so that link
+// prefetchers and mail scanners don't verify addresses.
+var verifyFormTemplate = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Verify email address</title></head>
+<body>
+<form method="post">
+<p>Publish the email address {{.Email}} with the OpenPGP key {{.Fingerprint}}?</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm</button>
+</form>
+</body>
+</html>
+`))
+
+func (v *Verifier) serveVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	switch r.Method {
+	case http.MethodGet:
+		token := r.FormValue("token")
+		fingerprint, email, err := v.parseToken(token, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data := struct {
+			Email, Fingerprint, Token string
+		}{
+			Email:       email,
+			Fingerprint: strings.ToUpper(hex.EncodeToString(fingerprint)),
+			Token:       token,
+		}
+		var b bytes.Buffer
+		if err := verifyFormTemplate.Execute(&b, &data); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(b.Bytes())
+	case http.MethodPost:
+		if err := v.Verify(r.PostFormValue("token")); err == errInvalidToken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Email address verified.\n"))
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
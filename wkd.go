@@ -0,0 +1,109 @@
+package hkp
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// zbase32 encodes data with the z-base-32 encoding.
+func zbase32(data []byte) string {
+	var sb strings.Builder
+	var buf, bits uint
+	for _, b := range data {
+		buf = buf<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			sb.WriteByte(zbase32Alphabet[buf>>bits&0x1F])
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(zbase32Alphabet[buf<<(5-bits)&0x1F])
+	}
+	return sb.String()
+}
+
+// WKDURLs returns the URLs of the keys of an email address in a Web Key
+// Directory, for the advanced and direct methods.
+func WKDURLs(email string) (advanced, direct string, err error) {
+	i := strings.LastIndexByte(email, '@')
+	if i <= 0 || i == len(email)-1 {
+		return "", "", fmt.Errorf("hkp: invalid email address %q", email)
+	}
+	localPart, domain := email[:i], strings.ToLower(email[i+1:])
+
+	sum := sha1.Sum([]byte(strings.ToLower(localPart)))
+	hash := zbase32(sum[:])
+	query := "?l=" + url.QueryEscape(localPart)
+
+	advanced = "https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/hu/" + hash + query
+	direct = "https://" + domain + "/.well-known/openpgpkey/hu/" + hash + query
+	return advanced, direct, nil
+}
+
+// WKDClient fetches keys from Web Key Directories.
+//
+// The advanced method is tried first. If the openpgpkey subdomain can't be
+// resolved, the direct method is used.
+type WKDClient struct {
+	// HTTPClient is the HTTP client used to send requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// Get fetches the keys of an email address.
+func (c *WKDClient) Get(email string) (openpgp.EntityList, error) {
+	return c.GetContext(context.Background(), email)
+}
+
+// GetContext is like Get, but with a context.
+func (c *WKDClient) GetContext(ctx context.Context, email string) (openpgp.EntityList, error) {
+	advanced, direct, err := WKDURLs(email)
+	if err != nil {
+		return nil, err
+	}
+
+	// The direct method is only used if the openpgpkey subdomain can't be
+	// resolved: other errors, such as TLS failures, are returned as-is
+	el, err := c.get(ctx, advanced)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && ctx.Err() == nil {
+		el, err = c.get(ctx, direct)
+	}
+	return el, err
+}
+
+func (c *WKDClient) get(ctx context.Context, u string) (openpgp.EntityList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp, "get WKD key")
+	}
+
+	return readKeyRing(resp.Body)
+}